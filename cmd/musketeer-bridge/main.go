@@ -8,15 +8,19 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
+	"musketeer-bridge/internal/auth"
 	"musketeer-bridge/internal/config"
 	"musketeer-bridge/internal/httpapi"
+	"musketeer-bridge/internal/idempotency"
 	"musketeer-bridge/internal/logstore"
 	"musketeer-bridge/internal/registry"
+	"musketeer-bridge/internal/scheduler"
 )
 
 func usage() string {
-	return "Usage:\n  musketeer-bridge serve\n  musketeer-bridge help\n  musketeer-bridge --help\n"
+	return "Usage:\n  musketeer-bridge serve\n  musketeer-bridge token create <name>\n  musketeer-bridge help\n  musketeer-bridge --help\n"
 }
 
 func fatalStructured(code, message string) {
@@ -41,13 +45,18 @@ func serve() error {
 	if err != nil {
 		return err
 	}
-	api := &httpapi.API{Cfg: cfg, Reg: reg, Log: logstore.LogWriter{RunsDir: cfg.RunsDir}}
+	sched := scheduler.New(cfg.MaxConcurrentRuns, cfg.MaxQueuedRuns, time.Duration(cfg.QueueTimeoutMs)*time.Millisecond)
+	idem := &idempotency.Store{Dir: cfg.IdempotencyDir, TTL: time.Duration(cfg.IdempotencyTTLMs) * time.Millisecond}
+	api := &httpapi.API{Cfg: cfg, Reg: reg, Log: logstore.LogWriter{RunsDir: cfg.RunsDir}, Sched: sched, Locks: scheduler.Locker{Dir: cfg.LocksDir}, Idem: idem}
 
 	ln, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
 		return err
 	}
 	log.Printf("listening on %s", cfg.ListenAddr)
+	if len(cfg.Clients) == 0 {
+		log.Printf("warning: no clients configured; any local process can run tools without a token (see musketeer-bridge token create)")
+	}
 
 	srv := &http.Server{Handler: api}
 	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -56,6 +65,23 @@ func serve() error {
 	return nil
 }
 
+// tokenCreate mints a bearer token for a new client. The token itself is only
+// printed here; bridge.json stores the name and token_sha256.
+func tokenCreate(name string) error {
+	tok, err := auth.NewToken()
+	if err != nil {
+		return err
+	}
+	c := config.Client{Name: name, TokenSHA256: auth.Hash(tok)}
+	if err := config.ValidateClients([]config.Client{c}); err != nil {
+		return err
+	}
+	b, _ := json.MarshalIndent(map[string]any{"token": tok, "client": c}, "", "  ")
+	fmt.Println(string(b))
+	fmt.Fprintln(os.Stderr, "Add \"client\" to \"clients\" in bridge.json. The token is not stored and cannot be shown again.")
+	return nil
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Fprint(os.Stderr, usage())
@@ -80,6 +106,14 @@ func main() {
 		if err := serve(); err != nil {
 			log.Fatal(err)
 		}
+	case "token":
+		if len(os.Args) != 4 || os.Args[2] != "create" || os.Args[3] == "" {
+			fmt.Fprint(os.Stderr, "Usage:\n  musketeer-bridge token create <name>\n")
+			os.Exit(2)
+		}
+		if err := tokenCreate(os.Args[3]); err != nil {
+			log.Fatal(err)
+		}
 	default:
 		fmt.Fprint(os.Stderr, usage())
 		os.Exit(2)
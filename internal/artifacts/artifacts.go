@@ -0,0 +1,96 @@
+// Package artifacts snapshots the files a tool declares as outputs and
+// reports how a run changed them.
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// File is one output file as found on disk.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+	SHA256 string `json:"sha256"`
+}
+
+// Artifact is a File plus what the run did to it: "created", "modified",
+// "deleted" or "unchanged". Deleted artifacts describe the file as it was
+// before the run.
+type Artifact struct {
+	File
+	Change string `json:"change"`
+}
+
+// Snapshot hashes the regular files under root matching any of globs
+// (filepath.Match syntax, relative to root). Paths are slash-separated and
+// relative to root. Files that cannot be read are left out.
+func Snapshot(root string, globs []string) map[string]File {
+	files := map[string]File{}
+	for _, g := range globs {
+		matches, err := filepath.Glob(filepath.Join(root, g))
+		if err != nil {
+			continue
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(root, m)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			if _, seen := files[rel]; seen {
+				continue
+			}
+			if f, ok := hashFile(m); ok {
+				f.Path = rel
+				files[rel] = f
+			}
+		}
+	}
+	return files
+}
+
+func hashFile(path string) (File, bool) {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return File{}, false
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return File{}, false
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return File{}, false
+	}
+	return File{Size: info.Size(), Mode: modeString(info.Mode()), SHA256: hex.EncodeToString(h.Sum(nil))}, true
+}
+
+// Diff compares snapshots taken before and after a run, sorted by path.
+func Diff(before, after map[string]File) []Artifact {
+	out := []Artifact{}
+	for p, f := range after {
+		prev, existed := before[p]
+		switch {
+		case !existed:
+			out = append(out, Artifact{File: f, Change: "created"})
+		case prev != f:
+			out = append(out, Artifact{File: f, Change: "modified"})
+		default:
+			out = append(out, Artifact{File: f, Change: "unchanged"})
+		}
+	}
+	for p, f := range before {
+		if _, ok := after[p]; !ok {
+			out = append(out, Artifact{File: f, Change: "deleted"})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
@@ -0,0 +1,47 @@
+package artifacts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, body string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	globs := []string{"packets/*.json"}
+	write("packets/keep.json", "{}")
+	write("packets/edit.json", "{}")
+	write("packets/gone.json", "{}")
+	write("packets/ignored.txt", "x")
+	before := Snapshot(root, globs)
+	if len(before) != 3 || before["packets/keep.json"].SHA256 != "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a" {
+		t.Fatalf("unexpected snapshot: %+v", before)
+	}
+	write("packets/edit.json", `{"a":1}`)
+	write("packets/new.json", "{}")
+	if err := os.Remove(filepath.Join(root, "packets", "gone.json")); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, a := range Diff(before, Snapshot(root, globs)) {
+		got[a.Path] = a.Change
+	}
+	want := map[string]string{"packets/keep.json": "unchanged", "packets/edit.json": "modified", "packets/gone.json": "deleted", "packets/new.json": "created"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for p, c := range want {
+		if got[p] != c {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
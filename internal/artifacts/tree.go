@@ -0,0 +1,165 @@
+package artifacts
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// TreeLimits bounds a SnapshotTree walk. Files larger than MaxFileBytes are
+// not hashed. Once MaxTotalBytes have been hashed the remaining files are not
+// hashed either, and the walk stops after MaxFiles files. Zero MaxTotalBytes
+// or MaxFiles means no limit.
+type TreeLimits struct {
+	MaxFileBytes  int64
+	MaxTotalBytes int64
+	MaxFiles      int
+}
+
+// SnapshotTree records every regular file under root that .gitignore files
+// do not exclude. The .git directory is always skipped. Unhashed files
+// compare by size and mode only. truncated reports that MaxTotalBytes or
+// MaxFiles was reached, so changes found with the snapshot may be incomplete.
+func SnapshotTree(root string, lim TreeLimits) (files map[string]File, truncated bool) {
+	files = map[string]File{}
+	ignores := map[string][]ignoreRule{}
+	var hashed int64
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == "." {
+				ignores["."] = readIgnore(p)
+				return nil
+			}
+			if d.Name() == ".git" || ignored(ignores, rel, true) {
+				return filepath.SkipDir
+			}
+			ignores[rel] = readIgnore(p)
+			return nil
+		}
+		if !d.Type().IsRegular() || ignored(ignores, rel, false) {
+			return nil
+		}
+		if lim.MaxFiles > 0 && len(files) >= lim.MaxFiles {
+			truncated = true
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		overTotal := lim.MaxTotalBytes > 0 && hashed+info.Size() > lim.MaxTotalBytes
+		if info.Size() > lim.MaxFileBytes || overTotal {
+			truncated = truncated || (overTotal && info.Size() <= lim.MaxFileBytes)
+			files[rel] = File{Path: rel, Size: info.Size(), Mode: modeString(info.Mode())}
+			return nil
+		}
+		if f, ok := hashFile(p); ok {
+			hashed += f.Size
+			f.Path = rel
+			files[rel] = f
+		}
+		return nil
+	})
+	return files, truncated
+}
+
+// ignoreRule is one .gitignore pattern. Patterns with a slash other than a
+// trailing one are anchored to the directory of their .gitignore.
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func readIgnore(dir string) []ignoreRule {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var rules []ignoreRule
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			r.negate, line = true, line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+		line = strings.TrimPrefix(line, "**/")
+		r.anchored = strings.Contains(line, "/")
+		r.pattern = strings.TrimPrefix(line, "/")
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// ignored applies the .gitignore rules of every ancestor directory of rel,
+// outermost first, so deeper files and later lines take precedence.
+func ignored(ignores map[string][]ignoreRule, rel string, isDir bool) bool {
+	out := false
+	dir := path.Dir(rel)
+	var chain []string
+	for d := dir; ; d = path.Dir(d) {
+		chain = append([]string{d}, chain...)
+		if d == "." {
+			break
+		}
+	}
+	for _, d := range chain {
+		sub := rel
+		if d != "." {
+			sub = strings.TrimPrefix(rel, d+"/")
+		}
+		for _, r := range ignores[d] {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			target := path.Base(sub)
+			if r.anchored {
+				target = sub
+			}
+			if strings.HasSuffix(r.pattern, "/**") && strings.HasPrefix(sub+"/", strings.TrimSuffix(r.pattern, "**")) {
+				out = !r.negate
+				continue
+			}
+			if ok, _ := path.Match(r.pattern, target); ok {
+				out = !r.negate
+			}
+		}
+	}
+	return out
+}
+
+func modeString(m fs.FileMode) string {
+	return fmt.Sprintf("%04o", m.Perm())
+}
+
+// Changes is Diff without the unchanged files.
+func Changes(before, after map[string]File) []Artifact {
+	out := []Artifact{}
+	for _, a := range Diff(before, after) {
+		if a.Change != "unchanged" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
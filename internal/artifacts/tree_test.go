@@ -0,0 +1,75 @@
+package artifacts
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotTreeRespectsGitignore(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":          "*.log\nbuild/\n/top.txt\n!keep.log\n",
+		"main.go":             "package main",
+		"debug.log":           "x",
+		"keep.log":            "x",
+		"top.txt":             "x",
+		"sub/top.txt":         "x",
+		"build/out.bin":       "x",
+		"sub/.gitignore":      "local.txt\n",
+		"sub/local.txt":       "x",
+		"sub/big.dat":         strings.Repeat("0123456789", 5),
+		".git/HEAD":           "ref",
+		"sub/nested/file.txt": "x",
+	}
+	for name, body := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, truncated := SnapshotTree(root, TreeLimits{MaxFileBytes: 40})
+	want := []string{".gitignore", "main.go", "keep.log", "sub/top.txt", "sub/.gitignore", "sub/big.dat", "sub/nested/file.txt"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, p := range want {
+		if _, ok := got[p]; !ok {
+			t.Fatalf("missing %s in %v", p, got)
+		}
+	}
+	if got["sub/big.dat"].SHA256 != "" || got["main.go"].SHA256 == "" || truncated {
+		t.Fatalf("expected only files within the cap to be hashed: %+v", got)
+	}
+}
+
+func TestSnapshotTreeLimits(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("f%d.txt", i)), []byte("0123456789"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, truncated := SnapshotTree(root, TreeLimits{MaxFileBytes: 40, MaxTotalBytes: 35})
+	unhashed := 0
+	for _, f := range got {
+		if f.SHA256 == "" {
+			unhashed++
+		}
+	}
+	if len(got) != 10 || unhashed != 7 || !truncated {
+		t.Fatalf("expected hashing to stop after 30 bytes, got %d files, %d unhashed, truncated=%v", len(got), unhashed, truncated)
+	}
+	got, truncated = SnapshotTree(root, TreeLimits{MaxFileBytes: 40, MaxFiles: 4})
+	if len(got) != 4 || !truncated {
+		t.Fatalf("expected the walk to stop after 4 files, got %d, truncated=%v", len(got), truncated)
+	}
+	if _, truncated = SnapshotTree(root, TreeLimits{MaxFileBytes: 40, MaxTotalBytes: 100, MaxFiles: 10}); truncated {
+		t.Fatal("expected a tree within the limits not to be truncated")
+	}
+}
@@ -0,0 +1,62 @@
+// Package auth implements bearer-token authentication of bridge clients.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"musketeer-bridge/internal/config"
+)
+
+// tokenPrefix marks bridge tokens so they are easy to spot in leaked text.
+const tokenPrefix = "mbt_"
+
+// NewToken returns a fresh random bearer token.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash is the value stored as a client's token_sha256.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the client whose token is presented in an
+// Authorization header of the form "Bearer <token>".
+func Authenticate(clients []config.Client, header string) (config.Client, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return config.Client{}, false
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	for _, c := range clients {
+		want, err := hex.DecodeString(c.TokenSHA256)
+		if err == nil && subtle.ConstantTimeCompare(sum[:], want) == 1 {
+			return c, true
+		}
+	}
+	return config.Client{}, false
+}
+
+type clientKey struct{}
+
+// WithClient records the authenticated client name in ctx.
+func WithClient(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, clientKey{}, name)
+}
+
+// ClientName is the authenticated client recorded by WithClient, if any.
+func ClientName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(clientKey{}).(string)
+	return name, ok
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"musketeer-bridge/internal/config"
+)
+
+func TestAuthenticate(t *testing.T) {
+	tok, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewToken()
+	if tok == other || !strings.HasPrefix(tok, tokenPrefix) {
+		t.Fatalf("unexpected tokens %q, %q", tok, other)
+	}
+	clients := []config.Client{{Name: "other", TokenSHA256: Hash(other)}, {Name: "agent", TokenSHA256: Hash(tok)}}
+	if err := config.ValidateClients(clients); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := Authenticate(clients, "Bearer "+tok); !ok || c.Name != "agent" {
+		t.Fatalf("expected agent, got %+v, %v", c, ok)
+	}
+	for _, h := range []string{"", tok, "Bearer", "Bearer ", "Basic " + tok, "Bearer " + tok + "x"} {
+		if _, ok := Authenticate(clients, h); ok {
+			t.Fatalf("expected %q to be rejected", h)
+		}
+	}
+}
+
+func TestClientName(t *testing.T) {
+	if _, ok := ClientName(context.Background()); ok {
+		t.Fatal("expected no client")
+	}
+	if name, ok := ClientName(WithClient(context.Background(), "agent")); !ok || name != "agent" {
+		t.Fatalf("expected agent, got %q", name)
+	}
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -18,13 +20,53 @@ func (e *ConfigError) Error() string {
 	return string(b)
 }
 
+// Root is one allowlisted root and the policy for runs inside it. In
+// bridge.json a root is either a path string or an object. Zero fields mean
+// no extra restriction: Tools empty allows every tool, and MaxRuntimeMs and
+// EnvAllowlist fall back to the daemon-wide values.
+type Root struct {
+	Path         string   `json:"path"`
+	Tools        []string `json:"tools,omitempty"`
+	ReadOnly     bool     `json:"read_only,omitempty"`
+	MaxRuntimeMs int      `json:"max_runtime_ms,omitempty"`
+	EnvAllowlist []string `json:"env_allowlist,omitempty"`
+	DenySubpaths []string `json:"deny_subpaths,omitempty"`
+}
+
+func (r *Root) UnmarshalJSON(b []byte) error {
+	var p string
+	if err := json.Unmarshal(b, &p); err == nil {
+		*r = Root{Path: p}
+		return nil
+	}
+	type plain Root
+	return json.Unmarshal(b, (*plain)(r))
+}
+
+// Client is a caller allowed to use the bridge. Only the SHA-256 of its bearer
+// token (hex encoded) is stored; see `musketeer-bridge token create`.
+type Client struct {
+	Name        string `json:"name"`
+	TokenSHA256 string `json:"token_sha256"`
+}
+
 type Config struct {
-	ListenAddr       string   `json:"listen_addr"`
-	AllowlistedRoots []string `json:"allowlisted_roots"`
-	EnvAllowlist     []string `json:"env_allowlist"`
-	MaxRuntimeMs     int      `json:"max_runtime_ms"`
-	RegistryDir      string   `json:"registry_dir"`
-	RunsDir          string   `json:"runs_dir"`
+	ListenAddr        string   `json:"listen_addr"`
+	AllowlistedRoots  []Root   `json:"allowlisted_roots"`
+	EnvAllowlist      []string `json:"env_allowlist"`
+	MaxRuntimeMs      int      `json:"max_runtime_ms"`
+	RegistryDir       string   `json:"registry_dir"`
+	RunsDir           string   `json:"runs_dir"`
+	MaxStdinBytes     int      `json:"max_stdin_bytes"`
+	SecretsDir        string   `json:"secrets_dir"`
+	MaxConcurrentRuns int      `json:"max_concurrent_runs"`
+	MaxQueuedRuns     int      `json:"max_queued_runs"`
+	QueueTimeoutMs    int      `json:"queue_timeout_ms"`
+	LocksDir          string   `json:"locks_dir"`
+	IdempotencyDir    string   `json:"idempotency_dir"`
+	IdempotencyTTLMs  int      `json:"idempotency_ttl_ms"`
+	ScratchDir        string   `json:"scratch_dir"`
+	Clients           []Client `json:"clients"`
 }
 
 func expandHome(p string) string {
@@ -37,12 +79,21 @@ func expandHome(p string) string {
 
 func Default() Config {
 	return Config{
-		ListenAddr:       "127.0.0.1:18789",
-		AllowlistedRoots: []string{},
-		EnvAllowlist:     []string{"PATH", "HOME", "USER", "SHELL", "TERM"},
-		MaxRuntimeMs:     600000,
-		RegistryDir:      "~/.musketeer/registry",
-		RunsDir:          "~/.musketeer/runs",
+		ListenAddr:        "127.0.0.1:18789",
+		AllowlistedRoots:  []Root{},
+		EnvAllowlist:      []string{"PATH", "HOME", "USER", "SHELL", "TERM"},
+		MaxRuntimeMs:      600000,
+		RegistryDir:       "~/.musketeer/registry",
+		RunsDir:           "~/.musketeer/runs",
+		MaxStdinBytes:     1 << 20,
+		SecretsDir:        "~/.config/jcn/env",
+		MaxConcurrentRuns: 8,
+		MaxQueuedRuns:     32,
+		QueueTimeoutMs:    30000,
+		LocksDir:          "~/.musketeer/locks",
+		IdempotencyDir:    "~/.musketeer/idempotency",
+		IdempotencyTTLMs:  86400000,
+		ScratchDir:        "~/.musketeer/scratch",
 	}
 }
 
@@ -58,6 +109,9 @@ func Load() (Config, error) {
 			}
 		}
 	}
+	if err := ValidateClients(cfg.Clients); err != nil {
+		return cfg, &ConfigError{Code: "ERR_CONFIG_INVALID", Message: err.Error()}
+	}
 	if v := os.Getenv("MUSKETEER_BRIDGE_LISTEN_ADDR"); v != "" {
 		cfg.ListenAddr = v
 	}
@@ -67,12 +121,36 @@ func Load() (Config, error) {
 	if v := os.Getenv("MUSKETEER_BRIDGE_RUNS_DIR"); v != "" {
 		cfg.RunsDir = v
 	}
+	if v := os.Getenv("MUSKETEER_BRIDGE_SECRETS_DIR"); v != "" {
+		cfg.SecretsDir = v
+	}
 	cfg.RegistryDir = expandHome(cfg.RegistryDir)
 	cfg.RunsDir = expandHome(cfg.RunsDir)
-	roots := make([]string, 0, len(cfg.AllowlistedRoots))
+	cfg.SecretsDir = expandHome(cfg.SecretsDir)
+	cfg.LocksDir = expandHome(cfg.LocksDir)
+	cfg.IdempotencyDir = expandHome(cfg.IdempotencyDir)
+	cfg.ScratchDir = expandHome(cfg.ScratchDir)
+	roots := make([]Root, 0, len(cfg.AllowlistedRoots))
 	for _, r := range cfg.AllowlistedRoots {
-		roots = append(roots, expandHome(r))
+		r.Path = expandHome(r.Path)
+		roots = append(roots, r)
 	}
 	cfg.AllowlistedRoots = roots
 	return cfg, nil
 }
+
+// ValidateClients checks that every client has a unique name and a
+// hex-encoded SHA-256 token hash.
+func ValidateClients(clients []Client) error {
+	seen := map[string]bool{}
+	for i, c := range clients {
+		if c.Name == "" || seen[c.Name] {
+			return fmt.Errorf("clients[%d]: name must be non-empty and unique", i)
+		}
+		seen[c.Name] = true
+		if b, err := hex.DecodeString(c.TokenSHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("clients[%d]: token_sha256 must be a hex SHA-256 hash", i)
+		}
+	}
+	return nil
+}
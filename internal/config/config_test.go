@@ -1,6 +1,7 @@
 package config_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	"musketeer-bridge/internal/config"
@@ -27,6 +28,20 @@ func TestDefaultMaxRuntimeMs(t *testing.T) {
 	}
 }
 
+func TestDefaultMaxStdinBytes(t *testing.T) {
+	cfg := config.Default()
+	if cfg.MaxStdinBytes != 1048576 {
+		t.Fatalf("expected max_stdin_bytes 1048576, got %d", cfg.MaxStdinBytes)
+	}
+}
+
+func TestDefaultConcurrencyLimits(t *testing.T) {
+	cfg := config.Default()
+	if cfg.MaxConcurrentRuns != 8 || cfg.MaxQueuedRuns != 32 || cfg.QueueTimeoutMs != 30000 {
+		t.Fatalf("unexpected concurrency defaults: %d/%d/%d", cfg.MaxConcurrentRuns, cfg.MaxQueuedRuns, cfg.QueueTimeoutMs)
+	}
+}
+
 func TestDefaultEnvAllowlist(t *testing.T) {
 	cfg := config.Default()
 	if len(cfg.EnvAllowlist) == 0 {
@@ -75,3 +90,45 @@ func TestRunsDirEnvOverride(t *testing.T) {
 		t.Fatalf("expected /tmp/test-runs, got %q", cfg.RunsDir)
 	}
 }
+
+func TestSecretsDirEnvOverride(t *testing.T) {
+	t.Setenv("MUSKETEER_BRIDGE_SECRETS_DIR", "/tmp/test-secrets")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.SecretsDir != "/tmp/test-secrets" {
+		t.Fatalf("expected /tmp/test-secrets, got %q", cfg.SecretsDir)
+	}
+}
+
+func TestRootsAcceptStringsAndObjects(t *testing.T) {
+	var cfg config.Config
+	b := []byte(`{"allowlisted_roots": ["/work/scratch", {"path": "/work/prod", "tools": ["musketeer"], "read_only": true, "deny_subpaths": [".env"]}]}`)
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	roots := cfg.AllowlistedRoots
+	if len(roots) != 2 || roots[0].Path != "/work/scratch" || roots[0].ReadOnly {
+		t.Fatalf("unexpected string root: %+v", roots)
+	}
+	if roots[1].Path != "/work/prod" || !roots[1].ReadOnly || len(roots[1].Tools) != 1 || roots[1].DenySubpaths[0] != ".env" {
+		t.Fatalf("unexpected object root: %+v", roots[1])
+	}
+}
+
+func TestValidateClients(t *testing.T) {
+	hash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	if err := config.ValidateClients([]config.Client{{Name: "a", TokenSHA256: hash}, {Name: "b", TokenSHA256: hash}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, clients := range [][]config.Client{
+		{{Name: "", TokenSHA256: hash}},
+		{{Name: "a", TokenSHA256: hash}, {Name: "a", TokenSHA256: hash}},
+		{{Name: "a", TokenSHA256: "secret"}},
+	} {
+		if err := config.ValidateClients(clients); err == nil {
+			t.Fatalf("expected %+v to be rejected", clients)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package contracttest
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -11,20 +14,37 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"musketeer-bridge/internal/auth"
 	"musketeer-bridge/internal/config"
 	"musketeer-bridge/internal/httpapi"
+	"musketeer-bridge/internal/idempotency"
 	"musketeer-bridge/internal/logstore"
+	"musketeer-bridge/internal/pty"
 	"musketeer-bridge/internal/registry"
+	"musketeer-bridge/internal/runner"
+	"musketeer-bridge/internal/sandbox"
+	"musketeer-bridge/internal/scheduler"
 )
 
 type runResp struct {
-	ExitCode int `json:"exit_code"`
-	Error    *struct {
+	RunID      string `json:"run_id"`
+	ExitCode   int    `json:"exit_code"`
+	TimeoutMs  int    `json:"timeout_ms"`
+	LockWaitMs int64  `json:"lock_wait_ms"`
+	Attempts   int    `json:"attempts"`
+	Error      *struct {
 		Code string `json:"code"`
 	} `json:"error,omitempty"`
 	StdoutJSON map[string]interface{} `json:"stdout_json,omitempty"`
+	Stdout     string                 `json:"stdout,omitempty"`
 	Stderr     string                 `json:"stderr,omitempty"`
+	Usage      *struct {
+		WallMs      int64 `json:"wall_ms"`
+		StdoutBytes int64 `json:"stdout_bytes"`
+		StderrBytes int64 `json:"stderr_bytes"`
+	} `json:"usage,omitempty"`
 }
 
 func buildFakeCLI(t *testing.T, outPath string) {
@@ -45,7 +65,7 @@ func buildBridgeCLI(t *testing.T, outPath string) {
 	}
 }
 
-func writeToolSpec(t *testing.T, registryDir, fakeCLI, behavior string) {
+func writeToolSpec(t *testing.T, registryDir, fakeCLI string, args []string, extra map[string]interface{}) {
 	t.Helper()
 	dir := filepath.Join(registryDir, "tools", "fake", "0.1.0")
 	if err := os.MkdirAll(dir, 0o755); err != nil {
@@ -57,10 +77,17 @@ func writeToolSpec(t *testing.T, registryDir, fakeCLI, behavior string) {
 		"description": "fake test tool",
 		"json_mode":   true,
 		"exec": map[string]interface{}{
-			"argv":         []string{fakeCLI, behavior},
+			"argv":         append([]string{fakeCLI}, args...),
 			"args_mapping": []interface{}{},
 		},
 	}
+	for k, v := range extra {
+		if k == "args_mapping" || k == "working_dir" {
+			spec["exec"].(map[string]interface{})[k] = v
+			continue
+		}
+		spec[k] = v
+	}
 	b, _ := json.MarshalIndent(spec, "", "  ")
 	if err := os.WriteFile(filepath.Join(dir, "tool.json"), b, 0o644); err != nil {
 		t.Fatal(err)
@@ -68,6 +95,20 @@ func writeToolSpec(t *testing.T, registryDir, fakeCLI, behavior string) {
 }
 
 func startServer(t *testing.T, workdir, behavior string, maxRuntime int) (*httptest.Server, string) {
+	t.Helper()
+	return startServerWith(t, workdir, maxRuntime, []string{behavior}, nil)
+}
+
+// startServerWith registers the fake tool with the given fakecli args and
+// extra top-level tool.json fields (args_mapping and working_dir go under
+// exec).
+func startServerWith(t *testing.T, workdir string, maxRuntime int, args []string, extra map[string]interface{}) (*httptest.Server, string) {
+	t.Helper()
+	return startServerCfg(t, workdir, maxRuntime, args, extra, nil)
+}
+
+// startServerCfg is startServerWith plus a hook to adjust the bridge config.
+func startServerCfg(t *testing.T, workdir string, maxRuntime int, args []string, extra map[string]interface{}, tweak func(*config.Config)) (*httptest.Server, string) {
 	t.Helper()
 	home := t.TempDir()
 	registryDir := filepath.Join(home, ".musketeer", "registry")
@@ -77,27 +118,36 @@ func startServer(t *testing.T, workdir, behavior string, maxRuntime int) (*httpt
 	}
 	fakeCLIPath := filepath.Join(home, "fakecli")
 	buildFakeCLI(t, fakeCLIPath)
-	writeToolSpec(t, registryDir, fakeCLIPath, behavior)
-	reg, err := registry.Load(registryDir)
-	if err != nil {
-		t.Fatal(err)
-	}
+	writeToolSpec(t, registryDir, fakeCLIPath, args, extra)
 	cfg := config.Config{
 		ListenAddr:       "127.0.0.1:0",
-		AllowlistedRoots: []string{workdir},
+		AllowlistedRoots: []config.Root{{Path: workdir}},
 		EnvAllowlist:     []string{"PATH", "HOME", "USER", "SHELL", "TERM"},
 		MaxRuntimeMs:     maxRuntime,
 		RegistryDir:      registryDir,
 		RunsDir:          runsDir,
 	}
-	api := &httpapi.API{Cfg: cfg, Reg: reg, Log: logstore.LogWriter{RunsDir: runsDir}}
+	if tweak != nil {
+		tweak(&cfg)
+	}
+	reg, err := registry.Load(registryDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched := scheduler.New(cfg.MaxConcurrentRuns, cfg.MaxQueuedRuns, time.Duration(cfg.QueueTimeoutMs)*time.Millisecond)
+	api := &httpapi.API{Cfg: cfg, Reg: reg, Log: logstore.LogWriter{RunsDir: runsDir}, Sched: sched, Locks: scheduler.Locker{Dir: filepath.Join(home, ".musketeer", "locks")}}
+	api.Idem = &idempotency.Store{Dir: filepath.Join(home, ".musketeer", "idempotency"), TTL: time.Hour}
 	return httptest.NewServer(api), runsDir
 }
 
 func postRun(t *testing.T, url, cwd string) runResp {
 	t.Helper()
-	body := []byte(`{"version":"0.1.0","args":{},"cwd":"` + cwd + `","env":{},"mode":"json","client":{"name":"test"}}`)
-	resp, err := http.Post(url+"/v1/tools/fake/run", "application/json", bytes.NewReader(body))
+	return postRunBody(t, url, `{"version":"0.1.0","args":{},"cwd":"`+cwd+`","env":{},"mode":"json","client":{"name":"test"}}`)
+}
+
+func postRunBody(t *testing.T, url, body string) runResp {
+	t.Helper()
+	resp, err := http.Post(url+"/v1/tools/fake/run", "application/json", strings.NewReader(body))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,6 +161,14 @@ func postRun(t *testing.T, url, cwd string) runResp {
 
 func latestRunDir(t *testing.T, runsDir string) string {
 	t.Helper()
+	latest := latestRunDirOrEmpty(runsDir)
+	if latest == "" {
+		t.Fatal("no run dir found")
+	}
+	return latest
+}
+
+func latestRunDirOrEmpty(runsDir string) string {
 	var latest string
 	_ = filepath.WalkDir(runsDir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
@@ -121,9 +179,6 @@ func latestRunDir(t *testing.T, runsDir string) string {
 		}
 		return nil
 	})
-	if latest == "" {
-		t.Fatal("no run dir found")
-	}
 	return latest
 }
 
@@ -148,6 +203,28 @@ func TestContractGoodJSON(t *testing.T) {
 	}
 }
 
+func TestContractUsageReported(t *testing.T) {
+	workdir := t.TempDir()
+	srv, runsDir := startServer(t, workdir, "good-json-stderr", 1000)
+	defer srv.Close()
+	r := postRun(t, srv.URL, workdir)
+	if r.Usage == nil {
+		t.Fatalf("expected usage in response, got %+v", r)
+	}
+	if r.Usage.StdoutBytes != int64(len(`{"ok":true,"mode":"good-json-stderr"}`)) || r.Usage.StderrBytes != int64(len("warning")) {
+		t.Fatalf("unexpected byte counts: %+v", *r.Usage)
+	}
+	rd := latestRunDir(t, runsDir)
+	var res map[string]interface{}
+	b, _ := os.ReadFile(filepath.Join(rd, "result.json"))
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res["usage"].(map[string]interface{}); !ok {
+		t.Fatalf("expected usage in result.json, got %v", res)
+	}
+}
+
 func TestContractBadJSONText(t *testing.T) {
 	workdir := t.TempDir()
 	srv, runsDir := startServer(t, workdir, "bad-json-text", 1000)
@@ -156,6 +233,9 @@ func TestContractBadJSONText(t *testing.T) {
 	if r.Error == nil || r.Error.Code != "ERR_STDOUT_NOT_JSON" {
 		t.Fatalf("expected ERR_STDOUT_NOT_JSON, got %+v", r)
 	}
+	if r.Stdout != "not-json" {
+		t.Fatalf("expected raw stdout to be kept, got %q", r.Stdout)
+	}
 	rd := latestRunDir(t, runsDir)
 	if _, err := os.Stat(filepath.Join(rd, "result.json")); err != nil {
 		t.Fatal(err)
@@ -165,6 +245,22 @@ func TestContractBadJSONText(t *testing.T) {
 	}
 }
 
+func TestContractFailedRunKeepsStdoutJSON(t *testing.T) {
+	workdir := t.TempDir()
+	srv, runsDir := startServer(t, workdir, "fail-exit-3", 1000)
+	defer srv.Close()
+	r := postRun(t, srv.URL, workdir)
+	if r.ExitCode != 3 || r.Error == nil || r.Error.Code != "ERR_EXEC_FAILED" {
+		t.Fatalf("expected ERR_EXEC_FAILED with exit 3, got %+v", r)
+	}
+	if r.StdoutJSON["mode"] != "fail-exit-3" {
+		t.Fatalf("expected parsed stdout_json, got %+v", r.StdoutJSON)
+	}
+	if _, err := os.Stat(filepath.Join(latestRunDir(t, runsDir), "stdout.json")); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestContractBadJSONMulti(t *testing.T) {
 	workdir := t.TempDir()
 	srv, runsDir := startServer(t, workdir, "bad-json-multi", 1000)
@@ -207,6 +303,963 @@ func TestContractTimeout(t *testing.T) {
 	}
 }
 
+func TestContractToolTimeout(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 5000, []string{"hang"}, map[string]interface{}{"timeout_ms": 100})
+	defer srv.Close()
+	r := postRun(t, srv.URL, workdir)
+	if r.Error == nil || r.Error.Code != "ERR_TIMEOUT" || r.TimeoutMs != 100 {
+		t.Fatalf("expected tool timeout of 100ms, got %+v", r)
+	}
+}
+
+func TestContractRequestTimeout(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServer(t, workdir, "hang", 5000)
+	defer srv.Close()
+	r := postRunBody(t, srv.URL, `{"args":{},"cwd":"`+workdir+`","mode":"json","timeout_ms":100}`)
+	if r.Error == nil || r.Error.Code != "ERR_TIMEOUT" || r.TimeoutMs != 100 {
+		t.Fatalf("expected request timeout of 100ms, got %+v", r)
+	}
+}
+
+func TestContractClientDisconnectCancelsRun(t *testing.T) {
+	workdir := t.TempDir()
+	srv, runsDir := startServerWith(t, workdir, 5000, []string{"hang", "3000"}, nil)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	body := `{"args":{},"cwd":"` + workdir + `","mode":"json"}`
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/v1/tools/fake/run", strings.NewReader(body))
+	start := time.Now()
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("expected client-side cancellation")
+	}
+	var res map[string]interface{}
+	for time.Since(start) < 2*time.Second {
+		rd := filepath.Join(latestRunDirOrEmpty(runsDir), "result.json")
+		if b, err := os.ReadFile(rd); err == nil {
+			_ = json.Unmarshal(b, &res)
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	errObj, _ := res["error"].(map[string]interface{})
+	if errObj == nil || errObj["code"] != "ERR_CANCELED" {
+		t.Fatalf("expected ERR_CANCELED in run log within 2s, got %v", res)
+	}
+}
+
+func TestContractStdinRaw(t *testing.T) {
+	workdir := t.TempDir()
+	srv, runsDir := startServerWith(t, workdir, 1000, []string{"echo-stdin"}, map[string]interface{}{"stdin": "raw", "redact_stdin": true})
+	defer srv.Close()
+	r := postRunBody(t, srv.URL, `{"args":{},"cwd":"`+workdir+`","mode":"json","stdin":"line1\nline2"}`)
+	if r.ExitCode != 0 || r.StdoutJSON["stdin"] != "line1\nline2" {
+		t.Fatalf("expected stdin echoed back, got %+v", r)
+	}
+	b, err := os.ReadFile(filepath.Join(latestRunDir(t, runsDir), "request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "line1") || !strings.Contains(string(b), "[redacted]") {
+		t.Fatalf("expected redacted stdin in request.json, got %s", b)
+	}
+}
+
+func TestContractStdinJSON(t *testing.T) {
+	workdir := t.TempDir()
+	srv, runsDir := startServerWith(t, workdir, 1000, []string{"echo-stdin"}, map[string]interface{}{"stdin": "json"})
+	defer srv.Close()
+	r := postRunBody(t, srv.URL, `{"args":{},"cwd":"`+workdir+`","mode":"json","stdin":{"packet":"p1"}}`)
+	if r.ExitCode != 0 || r.StdoutJSON["stdin"] != `{"packet":"p1"}` {
+		t.Fatalf("expected JSON stdin echoed back, got %+v", r)
+	}
+	b, err := os.ReadFile(filepath.Join(latestRunDir(t, runsDir), "request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "p1") {
+		t.Fatalf("expected stdin recorded in request.json, got %s", b)
+	}
+}
+
+func TestContractStdinRejectedByDefault(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServer(t, workdir, "echo-stdin", 1000)
+	defer srv.Close()
+	r := postRunBody(t, srv.URL, `{"args":{},"cwd":"`+workdir+`","mode":"json","stdin":"x"}`)
+	if r.Error == nil || r.Error.Code != "ERR_INVALID_INPUT" {
+		t.Fatalf("expected ERR_INVALID_INPUT, got %+v", r)
+	}
+}
+
+func TestContractToolEnvPolicy(t *testing.T) {
+	workdir := t.TempDir()
+	envPolicy := map[string]interface{}{"set": map[string]string{"NO_COLOR": "1"}, "deny": []string{"HOME"}}
+	srv, runsDir := startServerWith(t, workdir, 1000, []string{"env"}, map[string]interface{}{"env": envPolicy})
+	defer srv.Close()
+	r := postRunBody(t, srv.URL, `{"args":{},"cwd":"`+workdir+`","mode":"json","env":{"TERM":"dumb","NOT_ALLOWED":"x"}}`)
+	env, _ := r.StdoutJSON["env"].(map[string]interface{})
+	if env["NO_COLOR"] != "1" || env["TERM"] != "dumb" {
+		t.Fatalf("expected NO_COLOR and TERM in tool env, got %v", env)
+	}
+	if _, ok := env["HOME"]; ok {
+		t.Fatalf("denied HOME leaked into tool env: %v", env)
+	}
+	if _, ok := env["NOT_ALLOWED"]; ok {
+		t.Fatalf("unlisted request env leaked into tool env: %v", env)
+	}
+	var resolved struct {
+		Name        string `json:"name"`
+		ResolvedEnv struct {
+			Passed []struct {
+				Name   string `json:"name"`
+				Source string `json:"source"`
+			} `json:"passed"`
+			Dropped []string `json:"dropped"`
+		} `json:"resolved_env"`
+	}
+	b, _ := os.ReadFile(filepath.Join(latestRunDir(t, runsDir), "resolved.json"))
+	if err := json.Unmarshal(b, &resolved); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Name != "fake" || len(resolved.ResolvedEnv.Dropped) != 1 || resolved.ResolvedEnv.Dropped[0] != "NOT_ALLOWED" {
+		t.Fatalf("unexpected resolved.json: %s", b)
+	}
+	sources := map[string]string{}
+	for _, v := range resolved.ResolvedEnv.Passed {
+		sources[v.Name] = v.Source
+	}
+	if sources["NO_COLOR"] != "tool" || sources["TERM"] != "request" {
+		t.Fatalf("unexpected env sources: %v", sources)
+	}
+	if strings.Contains(string(b), "dumb") {
+		t.Fatalf("resolved.json must not contain env values: %s", b)
+	}
+}
+
+func TestContractSecretInjection(t *testing.T) {
+	workdir := t.TempDir()
+	secretsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(secretsDir, "fake.env"), []byte("FAKE_TOKEN=s3cr3t-value\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	refs := []map[string]string{{"name": "FAKE_TOKEN", "source": "fake.env"}}
+	srv, runsDir := startServerCfg(t, workdir, 1000, []string{"env"}, map[string]interface{}{"secrets": refs}, func(c *config.Config) {
+		c.SecretsDir = secretsDir
+	})
+	defer srv.Close()
+	r := postRun(t, srv.URL, workdir)
+	env, _ := r.StdoutJSON["env"].(map[string]interface{})
+	if r.ExitCode != 0 || env["FAKE_TOKEN"] != "[redacted]" {
+		t.Fatalf("expected injected secret to be redacted in output, got %+v", r)
+	}
+	rd := latestRunDir(t, runsDir)
+	entries, _ := os.ReadDir(rd)
+	for _, e := range entries {
+		b, _ := os.ReadFile(filepath.Join(rd, e.Name()))
+		if strings.Contains(string(b), "s3cr3t-value") {
+			t.Fatalf("secret value written to %s", e.Name())
+		}
+	}
+
+	refs = []map[string]string{{"name": "MISSING_TOKEN", "source": "fake.env"}}
+	srv2, _ := startServerCfg(t, workdir, 1000, []string{"env"}, map[string]interface{}{"secrets": refs}, func(c *config.Config) {
+		c.SecretsDir = secretsDir
+	})
+	defer srv2.Close()
+	r = postRun(t, srv2.URL, workdir)
+	if r.Error == nil || r.Error.Code != "ERR_SECRET_UNAVAILABLE" {
+		t.Fatalf("expected ERR_SECRET_UNAVAILABLE, got %+v", r)
+	}
+}
+
+func TestContractToolConcurrencyLimit(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 5000, []string{"hang", "500"}, map[string]interface{}{"max_concurrency": 1})
+	defer srv.Close()
+	done := make(chan runResp)
+	go func() { done <- postRun(t, srv.URL, workdir) }()
+	time.Sleep(150 * time.Millisecond)
+
+	body := `{"args":{},"cwd":"` + workdir + `","mode":"json"}`
+	resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var rr runResp
+	_ = json.NewDecoder(resp.Body).Decode(&rr)
+	if resp.StatusCode != 429 || rr.Error == nil || rr.Error.Code != "ERR_BUSY" || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 429 ERR_BUSY with Retry-After, got %d %+v", resp.StatusCode, rr)
+	}
+	if first := <-done; first.ExitCode != 0 {
+		t.Fatalf("expected first run to succeed, got %+v", first)
+	}
+}
+
+func TestContractWorkspaceLock(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServerCfg(t, workdir, 5000, []string{"hang", "300"}, map[string]interface{}{"lock": "cwd"}, func(c *config.Config) {
+		c.MaxQueuedRuns = 4
+		c.QueueTimeoutMs = 5000
+	})
+	defer srv.Close()
+	results := make(chan runResp, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- postRun(t, srv.URL, workdir) }()
+	}
+	a, b := <-results, <-results
+	if a.ExitCode != 0 || b.ExitCode != 0 {
+		t.Fatalf("expected both runs to succeed, got %+v and %+v", a, b)
+	}
+	if a.LockWaitMs < 200 && b.LockWaitMs < 200 {
+		t.Fatalf("expected one run to wait for the workspace lock, got %d and %d", a.LockWaitMs, b.LockWaitMs)
+	}
+}
+
+func postRunKey(t *testing.T, url, key, body string) (int, http.Header, runResp) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url+"/v1/tools/fake/run", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var rr runResp
+	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, rr
+}
+
+func TestContractIdempotencyReplay(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServer(t, workdir, "good-json", 1000)
+	defer srv.Close()
+	body := `{"args":{},"cwd":"` + workdir + `","mode":"json"}`
+	_, _, first := postRunKey(t, srv.URL, "retry-1", body)
+	status, hdr, second := postRunKey(t, srv.URL, "retry-1", body)
+	if first.RunID == "" || second.RunID != first.RunID || status != 200 || hdr.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected replay of run %q, got %d %+v", first.RunID, status, second)
+	}
+	status, _, conflict := postRunKey(t, srv.URL, "retry-1", `{"args":{"x":1},"cwd":"`+workdir+`","mode":"json"}`)
+	if status != 409 || conflict.Error == nil || conflict.Error.Code != "ERR_IDEMPOTENCY_CONFLICT" {
+		t.Fatalf("expected 409 ERR_IDEMPOTENCY_CONFLICT, got %d %+v", status, conflict)
+	}
+}
+
+func TestContractIdempotencyAttachesToRunningRun(t *testing.T) {
+	workdir := t.TempDir()
+	srv, runsDir := startServerWith(t, workdir, 5000, []string{"hang", "300"}, nil)
+	defer srv.Close()
+	body := `{"args":{},"cwd":"` + workdir + `","mode":"json","idempotency_key":"attach-1"}`
+	results := make(chan runResp, 2)
+	for i := 0; i < 2; i++ {
+		go func() { results <- postRunBody(t, srv.URL, body) }()
+	}
+	a, b := <-results, <-results
+	if a.RunID == "" || a.RunID != b.RunID || a.ExitCode != 0 {
+		t.Fatalf("expected both requests to share one run, got %+v and %+v", a, b)
+	}
+	runs := 0
+	_ = filepath.WalkDir(runsDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Name() == "result.json" {
+			runs++
+		}
+		return nil
+	})
+	if runs != 1 {
+		t.Fatalf("expected exactly one run log, got %d", runs)
+	}
+}
+
+type batchResp struct {
+	ExitCode int              `json:"exit_code"`
+	OK       bool             `json:"ok"`
+	BatchID  string           `json:"batch_id"`
+	Items    []map[string]any `json:"items"`
+}
+
+func postBatch(t *testing.T, url, body string) batchResp {
+	t.Helper()
+	resp, err := http.Post(url+"/v1/runs/batch", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var br batchResp
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		t.Fatal(err)
+	}
+	return br
+}
+
+func TestContractBatchSequential(t *testing.T) {
+	workdir := t.TempDir()
+	srv, runsDir := startServer(t, workdir, "good-json", 1000)
+	defer srv.Close()
+	br := postBatch(t, srv.URL, `{"cwd":"`+workdir+`","mode":"json","items":[{"tool":"fake","args":{}},{"tool":"fake","args":{}}]}`)
+	if !br.OK || br.ExitCode != 0 || br.BatchID == "" || len(br.Items) != 2 {
+		t.Fatalf("unexpected batch response: %+v", br)
+	}
+	if br.Items[0]["run_id"] == br.Items[1]["run_id"] {
+		t.Fatalf("expected a run log per item, got %+v", br.Items)
+	}
+	for _, it := range br.Items {
+		if it["parent_run_id"] != br.BatchID {
+			t.Fatalf("expected item linked to batch %s, got %v", br.BatchID, it)
+		}
+	}
+	var parent map[string]any
+	found := false
+	_ = filepath.WalkDir(runsDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() && d.Name() == br.BatchID {
+			b, _ := os.ReadFile(filepath.Join(path, "result.json"))
+			found = json.Unmarshal(b, &parent) == nil
+		}
+		return nil
+	})
+	if !found || len(parent["items"].([]any)) != 2 {
+		t.Fatalf("expected batch result.json with items, got %v", parent)
+	}
+}
+
+func TestContractBatchStopOnFailure(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServer(t, workdir, "fail-exit-3", 1000)
+	defer srv.Close()
+	br := postBatch(t, srv.URL, `{"cwd":"`+workdir+`","mode":"json","stop_on_failure":true,"items":[{"tool":"fake","args":{}},{"tool":"fake","args":{}}]}`)
+	if br.OK || br.ExitCode != 3 || br.Items[1]["skipped"] != true {
+		t.Fatalf("expected failure to stop the batch, got %+v", br)
+	}
+}
+
+func TestContractBatchParallel(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 5000, []string{"hang", "400"}, nil)
+	defer srv.Close()
+	start := time.Now()
+	br := postBatch(t, srv.URL, `{"cwd":"`+workdir+`","mode":"json","strategy":"parallel","items":[{"tool":"fake","args":{}},{"tool":"fake","args":{}},{"tool":"fake","args":{}}]}`)
+	if !br.OK || len(br.Items) != 3 {
+		t.Fatalf("unexpected batch response: %+v", br)
+	}
+	if elapsed := time.Since(start); elapsed > 1100*time.Millisecond {
+		t.Fatalf("expected parallel items to overlap, took %v", elapsed)
+	}
+}
+
+func TestContractBatchBusyRetryAfter(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 5000, []string{"hang", "300"}, map[string]interface{}{"max_concurrency": 1})
+	defer srv.Close()
+	body := `{"cwd":"` + workdir + `","mode":"json","strategy":"parallel","items":[{"tool":"fake","args":{}},{"tool":"fake","args":{}}]}`
+	resp, err := http.Post(srv.URL+"/v1/runs/batch", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var br batchResp
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		t.Fatal(err)
+	}
+	busy := 0
+	for _, it := range br.Items {
+		if e, _ := it["error"].(map[string]any); e != nil && e["code"] == "ERR_BUSY" {
+			busy++
+		}
+	}
+	if resp.StatusCode != 200 || busy != 1 || br.OK || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected 200 with one ERR_BUSY item and Retry-After, got %d %q %+v", resp.StatusCode, resp.Header.Get("Retry-After"), br)
+	}
+
+	resp2, err := http.Post(srv.URL+"/v1/runs/batch", "application/json", strings.NewReader(`{"cwd":"`+workdir+`","mode":"json","items":[{"tool":"fake","args":{}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != 200 || resp2.Header.Get("Retry-After") != "" {
+		t.Fatalf("expected no Retry-After without busy items, got %d %q", resp2.StatusCode, resp2.Header.Get("Retry-After"))
+	}
+}
+
+func TestContractRetryTransientFailure(t *testing.T) {
+	workdir := t.TempDir()
+	marker := filepath.Join(t.TempDir(), "attempted")
+	retry := map[string]interface{}{"max_attempts": 3, "backoff_ms": 10, "exit_codes": []int{75}}
+	srv, runsDir := startServerWith(t, workdir, 1000, []string{"fail-once", marker}, map[string]interface{}{"retry": retry})
+	defer srv.Close()
+	rr := postRun(t, srv.URL, workdir)
+	if rr.ExitCode != 0 || rr.Attempts != 2 {
+		t.Fatalf("expected success on the second attempt, got %+v", rr)
+	}
+	attempts, _ := filepath.Glob(filepath.Join(runsDir, "*", "*", "*", rr.RunID, "attempts", "*", "result.json"))
+	if len(attempts) != 2 {
+		t.Fatalf("expected two attempt logs, got %v", attempts)
+	}
+	b, err := os.ReadFile(attempts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first map[string]any
+	_ = json.Unmarshal(b, &first)
+	if first["exit_code"] != float64(75) {
+		t.Fatalf("expected first attempt to record exit 75, got %v", first)
+	}
+}
+
+func TestContractExitCodeMapping(t *testing.T) {
+	cases := []struct {
+		mapping    map[string]interface{}
+		wantStatus int
+		wantOK     bool
+		wantCode   string
+	}{
+		{map[string]interface{}{"code": "ERR_POLICY_DENIED", "message": "denied by policy", "http_status": 403}, 403, false, "ERR_POLICY_DENIED"},
+		{map[string]interface{}{"ok": true}, 200, true, ""},
+	}
+	for _, c := range cases {
+		workdir := t.TempDir()
+		extra := map[string]interface{}{"exit_codes": map[string]interface{}{"3": c.mapping}}
+		srv, _ := startServerWith(t, workdir, 1000, []string{"fail-exit-3"}, extra)
+		resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"json"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			OK       bool `json:"ok"`
+			ExitCode int  `json:"exit_code"`
+			Error    *struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		srv.Close()
+		if resp.StatusCode != c.wantStatus || body.OK != c.wantOK || body.ExitCode != 3 {
+			t.Fatalf("mapping %v: got status %d body %+v", c.mapping, resp.StatusCode, body)
+		}
+		if c.wantCode != "" && (body.Error == nil || body.Error.Code != c.wantCode || body.Error.Message != "denied by policy") {
+			t.Fatalf("mapping %v: unexpected error %+v", c.mapping, body.Error)
+		}
+		if c.wantCode == "" && body.Error != nil {
+			t.Fatalf("mapping %v: expected no error, got %+v", c.mapping, body.Error)
+		}
+	}
+}
+
+func TestContractJSONLines(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 1000, []string{"jsonl"}, map[string]interface{}{"output_format": "jsonl"})
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"jsonl"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		ExitCode   int              `json:"exit_code"`
+		StdoutJSON []map[string]any `json:"stdout_json"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ExitCode != 0 || len(body.StdoutJSON) != 3 || body.StdoutJSON[2]["event"] != float64(3) {
+		t.Fatalf("expected three events, got %+v", body)
+	}
+}
+
+func TestContractJSONLinesBadLine(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 1000, []string{"jsonl-bad"}, map[string]interface{}{"output_format": "jsonl"})
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"jsonl"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Error *struct {
+			Code string `json:"code"`
+			Line int    `json:"line"`
+		} `json:"error"`
+		Stdout string `json:"stdout"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error == nil || body.Error.Code != "ERR_STDOUT_NOT_JSON" || body.Error.Line != 2 || body.Stdout == "" {
+		t.Fatalf("expected ERR_STDOUT_NOT_JSON at line 2, got %+v", body)
+	}
+}
+
+func TestContractJSONLinesStream(t *testing.T) {
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 5000, []string{"jsonl", "300"}, map[string]interface{}{"output_format": "jsonl"})
+	defer srv.Close()
+	start := time.Now()
+	resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"jsonl","stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("expected ndjson, got %q", ct)
+	}
+	dec := json.NewDecoder(resp.Body)
+	var lines []map[string]any
+	var firstAt time.Duration
+	for {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			break
+		}
+		if len(lines) == 0 {
+			firstAt = time.Since(start)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 4 || lines[0]["type"] != "event" || lines[3]["type"] != "result" {
+		t.Fatalf("expected three events and a result, got %v", lines)
+	}
+	if total := time.Since(start); firstAt > total-500*time.Millisecond {
+		t.Fatalf("first event arrived at %v of %v, expected it before the tool finished", firstAt, total)
+	}
+	result, _ := lines[3]["result"].(map[string]any)
+	if result["exit_code"] != float64(0) {
+		t.Fatalf("unexpected final result %v", result)
+	}
+}
+
+func TestContractArtifacts(t *testing.T) {
+	workdir := t.TempDir()
+	srv, runsDir := startServerWith(t, workdir, 1000, []string{"write-file", "result.json"}, map[string]interface{}{"outputs": []string{"*.json"}})
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"json"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		ExitCode  int              `json:"exit_code"`
+		Artifacts []map[string]any `json:"artifacts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("fakecli"))
+	if body.ExitCode != 0 || len(body.Artifacts) != 1 {
+		t.Fatalf("expected one artifact, got %+v", body)
+	}
+	if a := body.Artifacts[0]; a["path"] != "result.json" || a["change"] != "created" || a["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected artifact %v", a)
+	}
+	if _, err := os.Stat(filepath.Join(latestRunDir(t, runsDir), "artifacts.json")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContractTrackChanges(t *testing.T) {
+	for _, policy := range []string{"warn", "fail"} {
+		workdir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(workdir, ".gitignore"), []byte("*.tmp\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		track := map[string]interface{}{"write_scope": []string{".musketeer"}, "on_violation": policy}
+		srv, runsDir := startServerWith(t, workdir, 1000, []string{"write-file", "stray.txt"}, map[string]interface{}{"track_changes": track})
+		resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"json"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			OK      bool             `json:"ok"`
+			Changes []map[string]any `json:"changes"`
+			Error   *struct {
+				Code string `json:"code"`
+			} `json:"error"`
+			Warnings []map[string]any `json:"warnings"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		srv.Close()
+		if len(body.Changes) != 1 || body.Changes[0]["path"] != "stray.txt" || body.Changes[0]["change"] != "created" {
+			t.Fatalf("%s: expected stray.txt to be reported as created, got %+v", policy, body.Changes)
+		}
+		if policy == "warn" && (!body.OK || len(body.Warnings) != 1) {
+			t.Fatalf("warn: expected a successful run with a warning, got %+v", body)
+		}
+		if policy == "fail" && (body.OK || body.Error == nil || body.Error.Code != "ERR_WRITE_SCOPE_VIOLATION") {
+			t.Fatalf("fail: expected ERR_WRITE_SCOPE_VIOLATION, got %+v", body)
+		}
+		if _, err := os.Stat(filepath.Join(latestRunDir(t, runsDir), "changes.json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestContractTrackChangesTruncated(t *testing.T) {
+	workdir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(workdir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	track := map[string]interface{}{"max_files": 2}
+	srv, _ := startServerWith(t, workdir, 1000, []string{"write-file", "stray.txt"}, map[string]interface{}{"track_changes": track})
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"json"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		OK       bool `json:"ok"`
+		Warnings []struct {
+			Code string `json:"code"`
+		} `json:"warnings"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	if !body.OK || len(body.Warnings) != 1 || body.Warnings[0].Code != "WARN_CHANGES_TRUNCATED" {
+		t.Fatalf("expected a WARN_CHANGES_TRUNCATED warning, got %+v", body)
+	}
+}
+
+func TestContractScratchWorkspace(t *testing.T) {
+	if err := sandbox.Available(); err != nil {
+		t.Skip(err)
+	}
+	workdir := t.TempDir()
+	scratch := t.TempDir()
+	srv, runsDir := startServerCfg(t, workdir, 5000, []string{"write-file", "out.txt"}, nil, func(c *config.Config) { c.ScratchDir = scratch })
+	defer srv.Close()
+	for _, keep := range []bool{false, true} {
+		body := fmt.Sprintf(`{"version":"0.1.0","args":{},"cwd":%q,"mode":"json","workspace":"scratch","keep_scratch":%t}`, workdir, keep)
+		resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rr struct {
+			ExitCode   int              `json:"exit_code"`
+			Changes    []map[string]any `json:"changes"`
+			Patch      string           `json:"patch"`
+			ScratchDir string           `json:"scratch_dir"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&rr)
+		resp.Body.Close()
+		if rr.ExitCode != 0 || len(rr.Changes) != 1 || rr.Changes[0]["path"] != "out.txt" || !strings.Contains(rr.Patch, "+++ b/out.txt\n@@ -0,0 +1,1 @@\n+fakecli") {
+			t.Fatalf("keep=%t: unexpected scratch response %+v", keep, rr)
+		}
+		if _, err := os.Stat(filepath.Join(workdir, "out.txt")); err == nil {
+			t.Fatal("scratch run modified the real workspace")
+		}
+		if _, err := os.Stat(filepath.Join(latestRunDir(t, runsDir), "patch.diff")); err != nil {
+			t.Fatal(err)
+		}
+		entries, _ := os.ReadDir(scratch)
+		if keep {
+			if _, err := os.Stat(filepath.Join(rr.ScratchDir, "out.txt")); err != nil || len(entries) != 1 {
+				t.Fatalf("expected kept scratch dir %q, got %v", rr.ScratchDir, err)
+			}
+		} else if len(entries) != 0 || rr.ScratchDir != "" {
+			t.Fatalf("expected scratch dir to be removed, found %v", entries)
+		}
+	}
+}
+
+func TestContractScratchConfined(t *testing.T) {
+	if err := sandbox.Available(); err != nil {
+		t.Skip(err)
+	}
+	workdir := t.TempDir()
+	escape := filepath.Join(workdir, "escape.txt")
+	srv, _ := startServerCfg(t, workdir, 5000, []string{"write-file", escape}, nil, func(c *config.Config) {
+		c.ScratchDir = t.TempDir()
+		c.AllowlistedRoots[0].ReadOnly = true
+	})
+	defer srv.Close()
+	rr := postRunBody(t, srv.URL, `{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"json","workspace":"scratch"}`)
+	if rr.ExitCode != 1 {
+		t.Fatalf("expected the write outside the scratch dir to fail, got %+v", rr)
+	}
+	if _, err := os.Stat(escape); err == nil {
+		t.Fatal("scratch run wrote to the original read-only root")
+	}
+}
+
+func TestContractTTY(t *testing.T) {
+	master, slave, err := pty.Open(24, 80)
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %v", err)
+	}
+	master.Close()
+	slave.Close()
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 5000, []string{"tty"}, map[string]interface{}{"json_mode": false, "tty": true, "strip_ansi": true})
+	defer srv.Close()
+	rr := postRunBody(t, srv.URL, `{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"text"}`)
+	if rr.ExitCode != 0 || rr.Stdout != "tty:true\nline2\n" {
+		t.Fatalf("expected plain tty output, got %+v", rr)
+	}
+	resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"text","stream":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	var lines []map[string]any
+	for {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 || lines[0]["event"].(map[string]any)["text"] != "tty:true" || lines[2]["type"] != "result" {
+		t.Fatalf("expected two streamed lines and a result, got %v", lines)
+	}
+}
+
+func TestContractCwdPolicy(t *testing.T) {
+	workdir := t.TempDir()
+	outside := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 1000, []string{"good-json"}, map[string]interface{}{"cwd_policy": "none"})
+	defer srv.Close()
+	for _, cwd := range []string{"", outside} {
+		rr := postRunBody(t, srv.URL, `{"version":"0.1.0","args":{},"cwd":"`+cwd+`","mode":"json"}`)
+		if rr.ExitCode != 0 || rr.StdoutJSON["mode"] != "good-json" {
+			t.Fatalf("cwd %q: expected a cwd-less tool to run, got %+v", cwd, rr)
+		}
+	}
+
+	srv2, _ := startServer(t, workdir, "good-json", 1000)
+	defer srv2.Close()
+	rr := postRunBody(t, srv2.URL, `{"version":"0.1.0","args":{},"mode":"json"}`)
+	if rr.Error == nil || rr.Error.Code != "ERR_INVALID_INPUT" {
+		t.Fatalf("expected ERR_INVALID_INPUT for a missing cwd, got %+v", rr)
+	}
+}
+
+func TestContractRootPolicy(t *testing.T) {
+	workdir := t.TempDir()
+	policy := func(r config.Root) func(*config.Config) {
+		return func(c *config.Config) {
+			r.Path = workdir
+			c.AllowlistedRoots = []config.Root{r}
+		}
+	}
+	srv, _ := startServerCfg(t, workdir, 1000, []string{"good-json"}, nil, policy(config.Root{Tools: []string{"other"}}))
+	rr := postRun(t, srv.URL, workdir)
+	srv.Close()
+	if rr.Error == nil || rr.Error.Code != "ERR_TOOL_NOT_ALLOWED" {
+		t.Fatalf("expected ERR_TOOL_NOT_ALLOWED, got %+v", rr)
+	}
+
+	srv, _ = startServerCfg(t, workdir, 1000, []string{"good-json"}, nil, policy(config.Root{Tools: []string{"fake"}, MaxRuntimeMs: 500}))
+	rr = postRun(t, srv.URL, workdir)
+	srv.Close()
+	if rr.ExitCode != 0 || rr.TimeoutMs != 500 {
+		t.Fatalf("expected the root's max_runtime_ms to apply, got %+v", rr)
+	}
+
+	if sandbox.Available() != nil {
+		t.Skip("sandbox unavailable; skipping read_only root")
+	}
+	srv, _ = startServerCfg(t, workdir, 5000, []string{"write-file", "out.txt"}, nil, policy(config.Root{ReadOnly: true}))
+	rr = postRun(t, srv.URL, workdir)
+	srv.Close()
+	if rr.ExitCode == 0 {
+		t.Fatalf("expected a write in a read_only root to fail, got %+v", rr)
+	}
+	if _, err := os.Stat(filepath.Join(workdir, "out.txt")); err == nil {
+		t.Fatal("read_only root was written to")
+	}
+}
+
+func TestContractWorkingDirRootPolicy(t *testing.T) {
+	workdir := t.TempDir()
+	sub := filepath.Join(workdir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	roots := func(strict config.Root) func(*config.Config) {
+		return func(c *config.Config) {
+			strict.Path = sub
+			c.AllowlistedRoots = []config.Root{{Path: workdir, EnvAllowlist: []string{"PATH", "HOME"}}, strict}
+		}
+	}
+	wd := map[string]interface{}{"working_dir": "sub"}
+
+	srv, _ := startServerCfg(t, workdir, 1000, []string{"good-json"}, wd, roots(config.Root{Tools: []string{"other"}}))
+	rr := postRun(t, srv.URL, workdir)
+	srv.Close()
+	if rr.Error == nil || rr.Error.Code != "ERR_TOOL_NOT_ALLOWED" {
+		t.Fatalf("expected the working_dir root's tools to apply, got %+v", rr)
+	}
+
+	srv, _ = startServerCfg(t, workdir, 1000, []string{"env"}, wd, roots(config.Root{MaxRuntimeMs: 500, EnvAllowlist: []string{"PATH", "USER"}}))
+	rr = postRun(t, srv.URL, workdir)
+	srv.Close()
+	env, _ := rr.StdoutJSON["env"].(map[string]interface{})
+	if rr.ExitCode != 0 || rr.TimeoutMs != 500 || env["PATH"] == nil || env["HOME"] != nil || env["USER"] != nil {
+		t.Fatalf("expected the stricter max_runtime_ms and intersected env_allowlist, got %+v", rr)
+	}
+}
+
+func TestContractPathArgs(t *testing.T) {
+	workdir := filepath.Join(t.TempDir(), "work")
+	outside := t.TempDir()
+	mapping := map[string]interface{}{"args_mapping": []interface{}{
+		map[string]interface{}{"input": "file", "flag": "--file", "kind": "path", "repeated": true},
+	}}
+	srv, _ := startServerWith(t, workdir, 1000, []string{"args"}, mapping)
+	defer srv.Close()
+	if err := os.Symlink(outside, filepath.Join(workdir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	realWork, _ := filepath.EvalSymlinks(workdir)
+	body := func(file string) string {
+		return `{"version":"0.1.0","args":{"file":` + file + `},"cwd":"` + workdir + `","env":{},"mode":"json","client":{"name":"test"}}`
+	}
+
+	rr := postRunBody(t, srv.URL, body(`["src/new.txt", "`+workdir+`/a"]`))
+	got, _ := json.Marshal(rr.StdoutJSON["args"])
+	want, _ := json.Marshal([]string{"--file", filepath.Join(realWork, "src", "new.txt"), "--file", filepath.Join(realWork, "a")})
+	if rr.ExitCode != 0 || string(got) != string(want) {
+		t.Fatalf("expected absolute path args %s, got %s (%+v)", want, got, rr)
+	}
+	for _, file := range []string{`"/etc/passwd"`, `"../x"`, `"escape/secret"`, `["ok", "` + outside + `"]`} {
+		rr = postRunBody(t, srv.URL, body(file))
+		if rr.Error == nil || rr.Error.Code != "ERR_PATH_NOT_ALLOWLISTED" {
+			t.Fatalf("expected ERR_PATH_NOT_ALLOWLISTED for %s, got %+v", file, rr)
+		}
+	}
+	rr = postRunBody(t, srv.URL, body(`42`))
+	if rr.Error == nil || rr.Error.Code != "ERR_INVALID_INPUT" {
+		t.Fatalf("expected ERR_INVALID_INPUT for a non-string path, got %+v", rr)
+	}
+}
+
+func TestContractArgConstraints(t *testing.T) {
+	workdir := t.TempDir()
+	mapping := map[string]interface{}{"args_mapping": []interface{}{
+		map[string]interface{}{"input": "branch", "flag": "--branch", "pattern": "[a-z0-9/-]+", "max_length": 20},
+		map[string]interface{}{"input": "depth", "flag": "--depth", "min": 1, "max": 10},
+		map[string]interface{}{"input": "msg", "flag": "-m"},
+	}}
+	srv, _ := startServerWith(t, workdir, 1000, []string{"args"}, mapping)
+	defer srv.Close()
+	post := func(args string) (int, runner.ErrPayload, map[string]interface{}) {
+		resp, err := http.Post(srv.URL+"/v1/tools/fake/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":`+args+`,"cwd":"`+workdir+`","mode":"json"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Error      *runner.ErrPayload     `json:"error"`
+			StdoutJSON map[string]interface{} `json:"stdout_json"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error == nil {
+			return resp.StatusCode, runner.ErrPayload{}, body.StdoutJSON
+		}
+		return resp.StatusCode, *body.Error, body.StdoutJSON
+	}
+
+	if status, e, out := post(`{"branch":"feat/x","depth":3,"msg":"fix: a - b"}`); status != 200 || e.Code != "" || out["ok"] != true {
+		t.Fatalf("expected valid args to run, got %d %+v", status, e)
+	}
+	status, e, _ := post(`{"branch":"--upload-pack=evil","depth":11,"msg":"a\nb"}`)
+	want := map[string]string{"branch": "leading_dash", "depth": "max", "msg": "control"}
+	if status != 400 || e.Code != "ERR_INVALID_INPUT" || len(e.Fields) != len(want) {
+		t.Fatalf("expected three field errors, got %d %+v", status, e)
+	}
+	for _, f := range e.Fields {
+		if want[f.Field] != f.Rule {
+			t.Fatalf("unexpected field error %+v", f)
+		}
+	}
+	if _, e, _ := post(`{"branch":"Feat X"}`); len(e.Fields) != 1 || e.Fields[0].Rule != "pattern" {
+		t.Fatalf("expected a pattern violation, got %+v", e)
+	}
+}
+
+func TestContractPipeline(t *testing.T) {
+	workdir := t.TempDir()
+	writePipeline := func(cfg *config.Config) {
+		dir := filepath.Join(cfg.RegistryDir, "tools", "chain", "0.1.0")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		spec := `{"name":"chain","version":"0.1.0","description":"fake chain","steps":[
+			{"id":"first","tool":"fake","version":"0.1.0"},
+			{"id":"second","tool":"fake","args_from":{"mode":{"step":"first","pointer":"/mode"},"label":{"pointer":"/label"}}},
+			{"id":"on_fail","tool":"fake","when":{"step":"second","exit_codes":[3]}}]}`
+		if err := os.WriteFile(filepath.Join(dir, "pipeline.json"), []byte(spec), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv, runsDir := startServerCfg(t, workdir, 1000, []string{"good-json"}, nil, writePipeline)
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+"/v1/tools/chain/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{"label":"x"},"cwd":"`+workdir+`","mode":"json"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var pr struct {
+		RunID    string           `json:"run_id"`
+		OK       bool             `json:"ok"`
+		ExitCode int              `json:"exit_code"`
+		Steps    []map[string]any `json:"steps"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || !pr.OK || pr.RunID == "" || len(pr.Steps) != 3 {
+		t.Fatalf("unexpected pipeline response %d: %+v", resp.StatusCode, pr)
+	}
+	if pr.Steps[0]["parent_run_id"] != pr.RunID || pr.Steps[1]["parent_run_id"] != pr.RunID {
+		t.Fatalf("expected steps linked to %s, got %+v", pr.RunID, pr.Steps)
+	}
+	if pr.Steps[2]["skipped"] != true {
+		t.Fatalf("expected conditional step to be skipped, got %+v", pr.Steps[2])
+	}
+	matches, _ := filepath.Glob(filepath.Join(runsDir, "*", "*", "*", pr.Steps[1]["run_id"].(string), "request.json"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one run log for step second, got %v", matches)
+	}
+	b, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req map[string]any
+	_ = json.Unmarshal(b, &req)
+	args, _ := req["args"].(map[string]any)
+	if args["mode"] != "good-json" || args["label"] != "x" {
+		t.Fatalf("expected args mapped from earlier output and request, got %v", req["args"])
+	}
+
+	for _, extra := range []string{`"workspace":"scratch"`, `"stdin":"secret-input"`, `"stream":true`} {
+		resp, err := http.Post(srv.URL+"/v1/tools/chain/run", "application/json", strings.NewReader(`{"version":"0.1.0","args":{},"cwd":"`+workdir+`","mode":"json",`+extra+`}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rej runResp
+		_ = json.NewDecoder(resp.Body).Decode(&rej)
+		resp.Body.Close()
+		if resp.StatusCode != 400 || rej.Error == nil || rej.Error.Code != "ERR_INVALID_INPUT" {
+			t.Fatalf("%s: expected the pipeline request to be rejected, got %d %+v", extra, resp.StatusCode, rej)
+		}
+		if b, _ := os.ReadFile(filepath.Join(latestRunDir(t, runsDir), "request.json")); strings.Contains(string(b), "secret-input") {
+			t.Fatalf("%s: rejected pipeline stdin was logged: %s", extra, b)
+		}
+	}
+}
+
 func TestContractAllowlistRejected(t *testing.T) {
 	workdir := t.TempDir()
 	srv, runsDir := startServer(t, workdir, "good-json", 1000)
@@ -222,6 +1275,118 @@ func TestContractAllowlistRejected(t *testing.T) {
 	}
 }
 
+func TestContractSandboxConfinesWrites(t *testing.T) {
+	if err := sandbox.Available(); err != nil {
+		t.Skip(err)
+	}
+	workdir := t.TempDir()
+	inside := filepath.Join(workdir, "out.txt")
+	srv, _ := startServerWith(t, workdir, 5000, []string{"write-file", inside}, map[string]interface{}{"sandbox": map[string]interface{}{}})
+	r := postRun(t, srv.URL, workdir)
+	srv.Close()
+	if r.ExitCode != 0 || r.StdoutJSON["ok"] != true {
+		t.Fatalf("expected write inside cwd to succeed, got %+v", r)
+	}
+
+	outside := filepath.Join(t.TempDir(), "out.txt")
+	srv, _ = startServerWith(t, workdir, 5000, []string{"write-file", outside}, map[string]interface{}{"sandbox": map[string]interface{}{}})
+	defer srv.Close()
+	r = postRun(t, srv.URL, workdir)
+	if r.ExitCode != 1 {
+		t.Fatalf("expected write outside cwd to fail, got %+v", r)
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Fatal("sandboxed tool wrote outside its write scope")
+	}
+}
+
+func TestContractSandboxDisablesNetwork(t *testing.T) {
+	if err := sandbox.Available(); err != nil {
+		t.Skip(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	workdir := t.TempDir()
+	srv, _ := startServerWith(t, workdir, 5000, []string{"dial", ln.Addr().String()}, map[string]interface{}{"sandbox": map[string]interface{}{}})
+	defer srv.Close()
+	r := postRun(t, srv.URL, workdir)
+	if r.ExitCode != 1 {
+		t.Fatalf("expected dial to fail inside sandbox, got %+v", r)
+	}
+}
+
+func TestContractAuth(t *testing.T) {
+	workdir := t.TempDir()
+	tok, _ := auth.NewToken()
+	srv, runsDir := startServerCfg(t, workdir, 1000, []string{"good-json"}, nil, func(c *config.Config) {
+		c.Clients = []config.Client{{Name: "ci", TokenSHA256: auth.Hash(tok)}}
+	})
+	defer srv.Close()
+	do := func(method, path, token, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	runBody := `{"version":"0.1.0","args":{},"cwd":"` + workdir + `","mode":"json","client":{"name":"spoofed"}}`
+
+	if resp := do(http.MethodGet, "/v1/health", "", ""); resp.StatusCode != 200 {
+		t.Fatalf("expected health without a token, got %d", resp.StatusCode)
+	}
+	for _, token := range []string{"", "mbt_wrong"} {
+		for _, path := range []string{"/v1/tools", "/v1/tools/fake"} {
+			if resp := do(http.MethodGet, path, token, ""); resp.StatusCode != 401 || resp.Header.Get("WWW-Authenticate") == "" {
+				t.Fatalf("expected 401 for %s with token %q, got %d", path, token, resp.StatusCode)
+			}
+		}
+		if resp := do(http.MethodPost, "/v1/tools/fake/run", token, runBody); resp.StatusCode != 401 {
+			t.Fatalf("expected 401 for run with token %q, got %d", token, resp.StatusCode)
+		}
+	}
+	if resp := do(http.MethodPost, "/v1/tools/fake/run", tok, runBody); resp.StatusCode != 200 {
+		t.Fatalf("expected authenticated run to succeed, got %d", resp.StatusCode)
+	}
+	b, err := os.ReadFile(filepath.Join(latestRunDir(t, runsDir), "request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged runner.RunRequest
+	if err := json.Unmarshal(b, &logged); err != nil {
+		t.Fatal(err)
+	}
+	if logged.Client["name"] != "ci" || logged.Client["authenticated"] != true {
+		t.Fatalf("expected the authenticated client in request.json, got %s", b)
+	}
+}
+
+func TestContractTokenCreate(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "musketeer-bridge")
+	buildBridgeCLI(t, bin)
+	out, err := exec.Command(bin, "token", "create", "ci").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var minted struct {
+		Token  string        `json:"token"`
+		Client config.Client `json:"client"`
+	}
+	if err := json.Unmarshal(out, &minted); err != nil {
+		t.Fatalf("expected JSON output, got %s", out)
+	}
+	if c, ok := auth.Authenticate([]config.Client{minted.Client}, "Bearer "+minted.Token); !ok || c.Name != "ci" {
+		t.Fatalf("minted token does not match its hash: %s", out)
+	}
+}
+
 func TestContractHelpDoesNotBind(t *testing.T) {
 	bin := filepath.Join(t.TempDir(), "musketeer-bridge")
 	buildBridgeCLI(t, bin)
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -33,6 +37,79 @@ func main() {
 	case "fail-exit-3":
 		fmt.Print("{\"ok\":false,\"mode\":\"fail-exit-3\"}")
 		os.Exit(3)
+	case "echo-stdin":
+		b, _ := io.ReadAll(os.Stdin)
+		out, _ := json.Marshal(map[string]interface{}{"ok": true, "mode": "echo-stdin", "stdin": string(b)})
+		fmt.Print(string(out))
+		os.Exit(0)
+	case "env":
+		env := map[string]string{}
+		for _, kv := range os.Environ() {
+			if i := strings.Index(kv, "="); i > 0 {
+				env[kv[:i]] = kv[i+1:]
+			}
+		}
+		out, _ := json.Marshal(map[string]interface{}{"ok": true, "mode": "env", "env": env})
+		fmt.Print(string(out))
+		os.Exit(0)
+	case "write-file":
+		if len(os.Args) < 3 {
+			fmt.Print("missing-path")
+			os.Exit(2)
+		}
+		if err := os.WriteFile(os.Args[2], []byte("fakecli"), 0o644); err != nil {
+			fmt.Printf("{\"ok\":false,\"mode\":\"write-file\",\"error\":%q}", err.Error())
+			os.Exit(1)
+		}
+		fmt.Print("{\"ok\":true,\"mode\":\"write-file\"}")
+		os.Exit(0)
+	case "args":
+		out, _ := json.Marshal(map[string]interface{}{"ok": true, "mode": "args", "args": os.Args[2:]})
+		fmt.Print(string(out))
+		os.Exit(0)
+	case "dial":
+		if len(os.Args) < 3 {
+			fmt.Print("missing-addr")
+			os.Exit(2)
+		}
+		c, err := net.Dial("tcp", os.Args[2])
+		if err != nil {
+			fmt.Printf("{\"ok\":false,\"mode\":\"dial\",\"error\":%q}", err.Error())
+			os.Exit(1)
+		}
+		c.Close()
+		fmt.Print("{\"ok\":true,\"mode\":\"dial\"}")
+		os.Exit(0)
+	case "fail-once":
+		if len(os.Args) < 3 {
+			fmt.Print("missing-path")
+			os.Exit(2)
+		}
+		if _, err := os.Stat(os.Args[2]); err != nil {
+			_ = os.WriteFile(os.Args[2], []byte("fakecli"), 0o644)
+			fmt.Fprint(os.Stderr, "busy")
+			os.Exit(75)
+		}
+		fmt.Print("{\"ok\":true,\"mode\":\"fail-once\"}")
+		os.Exit(0)
+	case "jsonl":
+		delayMs := 0
+		if len(os.Args) >= 3 {
+			delayMs, _ = strconv.Atoi(os.Args[2])
+		}
+		for i := 1; i <= 3; i++ {
+			fmt.Printf("{\"event\":%d}\n", i)
+			time.Sleep(time.Duration(delayMs) * time.Millisecond)
+		}
+		os.Exit(0)
+	case "jsonl-bad":
+		fmt.Print("{\"event\":1}\nnot-json\n{\"event\":3}\n")
+		os.Exit(0)
+	case "tty":
+		info, err := os.Stdout.Stat()
+		isTTY := err == nil && info.Mode()&os.ModeCharDevice != 0
+		fmt.Printf("\x1b[32mtty:%t\x1b[0m\nline2\n", isTTY)
+		os.Exit(0)
 	case "hang":
 		sleepMs := 2000
 		if len(os.Args) >= 3 {
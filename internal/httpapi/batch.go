@@ -0,0 +1,125 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"musketeer-bridge/internal/runner"
+)
+
+// BatchItem is one tool invocation in a batch.
+type BatchItem struct {
+	Tool    string                 `json:"tool"`
+	Version string                 `json:"version,omitempty"`
+	Args    map[string]interface{} `json:"args"`
+}
+
+// BatchRequest runs several tools against one cwd. Strategy is "sequential"
+// (the default) or "parallel"; StopOnFailure only applies to sequential.
+type BatchRequest struct {
+	Cwd           string                 `json:"cwd"`
+	Env           map[string]string      `json:"env,omitempty"`
+	Client        map[string]interface{} `json:"client,omitempty"`
+	Mode          string                 `json:"mode"`
+	Strategy      string                 `json:"strategy,omitempty"`
+	StopOnFailure bool                   `json:"stop_on_failure,omitempty"`
+	Items         []BatchItem            `json:"items"`
+}
+
+func (a *API) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var breq BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&breq); err != nil {
+		res := errBody("ERR_INVALID_INPUT", "invalid json")
+		a.writeRunLog(map[string]any{"raw": "decode_error"}, nil, nil, "", res)
+		writeJSON(w, 400, res)
+		return
+	}
+	breq.Client = clientIdentity(r, breq.Client)
+	if breq.Strategy == "" {
+		breq.Strategy = "sequential"
+	}
+	if len(breq.Items) == 0 || (breq.Strategy != "sequential" && breq.Strategy != "parallel") {
+		res := errBody("ERR_INVALID_INPUT", "batch needs items and a strategy of sequential or parallel")
+		a.writeRunLog(breq, nil, nil, "", res)
+		writeJSON(w, 400, res)
+		return
+	}
+	for i, it := range breq.Items {
+		if _, ok := a.Reg.Tools[it.Tool]; !ok {
+			res := errBody("ERR_TOOL_NOT_FOUND", fmt.Sprintf("items[%d]: tool %q not found", i, it.Tool))
+			a.writeRunLog(breq, nil, nil, "", res)
+			writeJSON(w, 404, res)
+			return
+		}
+	}
+
+	batchID, dir, logErr := a.Log.NewRunDir()
+	items := make([]map[string]any, len(breq.Items))
+	var busy atomic.Bool
+	run := func(i int) loggedRun {
+		it := breq.Items[i]
+		req := runner.RunRequest{Version: it.Version, Mode: breq.Mode, Cwd: breq.Cwd, Env: breq.Env, Args: it.Args, Client: breq.Client}
+		lr := a.runAndLog(r.Context(), it.Tool, a.Reg.Tools[it.Tool], req, batchID, nil)
+		lr.resp["tool"] = it.Tool
+		items[i] = lr.resp
+		if lr.result.Error != nil && lr.result.Error.Code == "ERR_BUSY" {
+			busy.Store(true)
+		}
+		return lr
+	}
+	if breq.Strategy == "parallel" {
+		var wg sync.WaitGroup
+		var fanout chan struct{}
+		if a.Cfg.MaxConcurrentRuns > 0 {
+			fanout = make(chan struct{}, a.Cfg.MaxConcurrentRuns)
+		}
+		for i := range breq.Items {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if fanout != nil {
+					fanout <- struct{}{}
+					defer func() { <-fanout }()
+				}
+				run(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range breq.Items {
+			if lr := run(i); !lr.result.OK && breq.StopOnFailure {
+				for j := i + 1; j < len(breq.Items); j++ {
+					items[j] = map[string]any{"tool": breq.Items[j].Tool, "skipped": true}
+				}
+				break
+			}
+		}
+	}
+
+	resp := map[string]any{"exit_code": 0, "ok": true, "strategy": breq.Strategy, "items": items}
+	for _, it := range items {
+		if it["skipped"] == true {
+			continue
+		}
+		if it["ok"] != true {
+			resp["ok"] = false
+			resp["exit_code"] = it["exit_code"]
+			resp["error"] = it["error"]
+			break
+		}
+	}
+	if logErr == nil {
+		resp["batch_id"] = batchID
+		a.Log.WriteAll(dir, breq, nil, nil, "", resp)
+	}
+	// The batch itself ran, so it is always 200; items rejected with
+	// ERR_BUSY get the same backoff hint as a 429 from a single run.
+	if busy.Load() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(a.Sched.RetryAfter().Seconds())))
+	}
+	writeJSON(w, 200, resp)
+}
@@ -1,20 +1,34 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"musketeer-bridge/internal/auth"
 	"musketeer-bridge/internal/config"
+	"musketeer-bridge/internal/idempotency"
 	"musketeer-bridge/internal/logstore"
 	"musketeer-bridge/internal/registry"
 	"musketeer-bridge/internal/runner"
+	"musketeer-bridge/internal/scheduler"
 )
 
 type API struct {
 	Cfg config.Config
 	Reg registry.Registry
 	Log logstore.LogWriter
+	// Sched bounds concurrent runs; nil means unlimited.
+	Sched *scheduler.Scheduler
+	// Locks serializes runs of tools that declare a workspace lock.
+	Locks scheduler.Locker
+	// Idem replays runs by idempotency key; nil disables keys.
+	Idem *idempotency.Store
 }
 
 func writeJSON(w http.ResponseWriter, status int, body any) {
@@ -31,56 +45,349 @@ func (a *API) writeRunLog(req any, resolved any, stdoutJSON any, stderr string,
 	a.Log.WriteAll(dir, req, resolved, stdoutJSON, stderr, result)
 }
 
+func (a *API) runOptions() runner.Options {
+	return runner.Options{
+		Roots:         a.Cfg.AllowlistedRoots,
+		EnvAllow:      a.Cfg.EnvAllowlist,
+		TimeoutMs:     a.Cfg.MaxRuntimeMs,
+		MaxStdinBytes: a.Cfg.MaxStdinBytes,
+		SecretsDir:    a.Cfg.SecretsDir,
+		ScratchDir:    a.Cfg.ScratchDir,
+	}
+}
+
+// runTool takes the tool's workspace lock (if any), waits for a scheduler
+// slot and then executes one tool run. onEvent, if set, receives jsonl
+// events as they are parsed.
+func (a *API) runTool(ctx context.Context, name string, spec registry.ToolSpec, req runner.RunRequest, onEvent func(int, any)) runner.RunResult {
+	var lockWait time.Duration
+	if p := runner.LockPath(spec, req.Cwd, a.Cfg.AllowlistedRoots); p != "" {
+		unlock, waited, err := a.Locks.Lock(ctx, p, time.Duration(a.Cfg.QueueTimeoutMs)*time.Millisecond)
+		if err != nil {
+			res := waitErr(err, "workspace is locked by another run")
+			res.LockWaitMs = waited.Milliseconds()
+			return res
+		}
+		defer unlock()
+		lockWait = waited
+	}
+	release, waited, err := a.Sched.Acquire(ctx, name, spec.MaxConcurrency)
+	if err != nil {
+		res := waitErr(err, err.Error())
+		res.QueueWaitMs, res.LockWaitMs = waited.Milliseconds(), lockWait.Milliseconds()
+		return res
+	}
+	defer release()
+	opts := a.runOptions()
+	opts.OnEvent = onEvent
+	res := runner.Run(ctx, spec, req, opts)
+	res.QueueWaitMs, res.LockWaitMs = waited.Milliseconds(), lockWait.Milliseconds()
+	return res
+}
+
+// waitErr turns a failed lock or slot wait into a run result.
+func waitErr(err error, busyMsg string) runner.RunResult {
+	if errors.Is(err, context.Canceled) {
+		return runner.RunResult{ExitCode: 130, Error: &runner.ErrPayload{Code: "ERR_CANCELED", Message: "run canceled by client"}}
+	}
+	if errors.Is(err, scheduler.ErrBusy) {
+		return runner.RunResult{ExitCode: 75, Error: &runner.ErrPayload{Code: "ERR_BUSY", Message: busyMsg}}
+	}
+	return runner.RunResult{ExitCode: 70, Error: &runner.ErrPayload{Code: "ERR_EXEC_FAILED", Message: err.Error()}}
+}
+
+func runResponse(result runner.RunResult) map[string]any {
+	resp := map[string]any{"exit_code": result.ExitCode, "ok": result.OK, "stdout": result.Stdout, "stderr": result.Stderr, "timeout_ms": result.TimeoutMs, "queue_wait_ms": result.QueueWaitMs, "lock_wait_ms": result.LockWaitMs}
+	if result.StdoutJS != nil {
+		resp["stdout_json"] = result.StdoutJS
+	}
+	if result.Error != nil {
+		resp["error"] = result.Error
+	}
+	if result.Usage != nil {
+		resp["usage"] = result.Usage
+	}
+	resp["attempts"] = max(len(result.Attempts), 1)
+	if result.Artifacts != nil {
+		resp["artifacts"] = result.Artifacts
+	}
+	if result.Changes != nil {
+		resp["changes"] = result.Changes
+	}
+	if len(result.Warnings) > 0 {
+		resp["warnings"] = result.Warnings
+	}
+	if result.Patch != "" {
+		resp["patch"] = result.Patch
+	}
+	if result.ScratchDir != "" {
+		resp["scratch_dir"] = result.ScratchDir
+	}
+	return resp
+}
+
+func runStatus(result runner.RunResult) int {
+	if result.HTTPStatus != 0 {
+		return result.HTTPStatus
+	}
+	if result.Error == nil {
+		return 200
+	}
+	switch {
+	case result.Error.Code == "ERR_BUSY":
+		return 429
+	case result.ExitCode == 70:
+		return 500
+	}
+	return 400
+}
+
+// resolvedLog is written to resolved.json: the tool spec used plus what the
+// bridge resolved from it.
+type resolvedLog struct {
+	registry.ToolSpec
+	ResolvedEnv *runner.EnvResolution `json:"resolved_env,omitempty"`
+}
+
+// loggedRequest is the request as written to request.json.
+func loggedRequest(spec registry.ToolSpec, req runner.RunRequest) runner.RunRequest {
+	if spec.RedactStdin && req.Stdin != nil {
+		req.Stdin = "[redacted]"
+	}
+	return req
+}
+
+func errBody(code, msg string) map[string]any {
+	return map[string]any{"exit_code": 40, "error": map[string]any{"code": code, "message": msg}}
+}
+
+// loopbackHost reports whether a Host header names this machine: localhost
+// or a loopback IP, with or without a port. Without auth this is what stops a
+// web page from reaching the bridge through DNS rebinding.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// clientIdentity is the client recorded for a run: the authenticated client
+// when auth is on, otherwise whatever the request declared.
+func clientIdentity(r *http.Request, declared map[string]interface{}) map[string]interface{} {
+	if name, ok := auth.ClientName(r.Context()); ok {
+		return map[string]interface{}{"name": name, "authenticated": true}
+	}
+	return declared
+}
+
+func (a *API) handleRun(w http.ResponseWriter, r *http.Request, name string) {
+	spec, ok := a.Reg.Tools[name]
+	pipeline, isPipeline := a.Reg.Pipelines[name]
+	ok = ok || isPipeline
+	var req runner.RunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		res := errBody("ERR_INVALID_INPUT", "invalid json")
+		a.writeRunLog(map[string]any{"raw": "decode_error"}, nil, nil, "", res)
+		writeJSON(w, 400, res)
+		return
+	}
+	req.Client = clientIdentity(r, req.Client)
+	if !ok {
+		res := errBody("ERR_TOOL_NOT_FOUND", "tool not found")
+		a.writeRunLog(req, nil, nil, "", res)
+		writeJSON(w, 404, res)
+		return
+	}
+	if isPipeline {
+		if msg := pipelineRequestErr(req); msg != "" {
+			res := errBody("ERR_INVALID_INPUT", msg)
+			// A pipeline has no redact_stdin of its own, so stdin is never logged.
+			a.writeRunLog(loggedRequest(registry.ToolSpec{RedactStdin: true}, req), nil, nil, "", res)
+			writeJSON(w, 400, res)
+			return
+		}
+	}
+	var stream *eventStream
+	var onEvent func(int, any)
+	if req.Stream {
+		if req.Mode != "jsonl" && !spec.TTY {
+			res := errBody("ERR_INVALID_INPUT", "stream requires mode jsonl or a tty tool")
+			a.writeRunLog(loggedRequest(spec, req), nil, nil, "", res)
+			writeJSON(w, 400, res)
+			return
+		}
+		stream = &eventStream{w: w}
+		onEvent = stream.send
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = req.IdempotencyKey
+	} else if req.IdempotencyKey != "" && req.IdempotencyKey != key {
+		res := errBody("ERR_INVALID_INPUT", "Idempotency-Key header and idempotency_key differ")
+		a.writeRunLog(loggedRequest(spec, req), nil, nil, "", res)
+		writeJSON(w, 400, res)
+		return
+	}
+	if a.Idem == nil {
+		key = ""
+	}
+	if key != "" {
+		req.IdempotencyKey = key
+		rec, owner, err := a.claimKey(r.Context(), key, name, req)
+		if err != nil {
+			status, res := 409, errBody("ERR_IDEMPOTENCY_CONFLICT", err.Error())
+			if !errors.Is(err, idempotency.ErrConflict) {
+				status, res = 400, map[string]any{"exit_code": 130, "error": map[string]any{"code": "ERR_CANCELED", "message": "run canceled by client"}}
+			}
+			a.writeRunLog(loggedRequest(spec, req), nil, nil, "", res)
+			writeJSON(w, status, res)
+			return
+		}
+		if !owner {
+			res, err := a.Log.ReadResult(rec.RunDir)
+			if err != nil {
+				writeJSON(w, 409, errBody("ERR_IDEMPOTENCY_CONFLICT", "original run log is unavailable"))
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, rec.Status, res)
+			return
+		}
+	}
+	var lr loggedRun
+	if isPipeline {
+		lr = a.runPipeline(r.Context(), pipeline, req)
+	} else {
+		lr = a.runAndLog(r.Context(), name, spec, req, "", onEvent)
+	}
+	status := runStatus(lr.result)
+	if key != "" {
+		if lr.dir == "" || status == 429 || lr.result.ExitCode == 130 {
+			a.Idem.Abandon(key)
+		} else {
+			a.Idem.Finish(key, lr.runID, lr.dir, status)
+		}
+	}
+	if status == 429 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(a.Sched.RetryAfter().Seconds())))
+	}
+	if stream != nil {
+		stream.finish(status, lr.resp)
+		return
+	}
+	writeJSON(w, status, lr.resp)
+}
+
+// loggedRun is one executed tool run and where it was logged. dir is empty
+// when the run log could not be created.
+type loggedRun struct {
+	runID  string
+	dir    string
+	result runner.RunResult
+	resp   map[string]any
+}
+
+// runAndLog executes one tool run and writes its run log. parentID links the
+// run to the batch or pipeline run that started it.
+func (a *API) runAndLog(ctx context.Context, name string, spec registry.ToolSpec, req runner.RunRequest, parentID string, onEvent func(int, any)) loggedRun {
+	runID, dir, logErr := a.Log.NewRunDir()
+	result := a.runTool(ctx, name, spec, req, onEvent)
+	resp := runResponse(result)
+	if parentID != "" {
+		resp["parent_run_id"] = parentID
+	}
+	if logErr != nil {
+		return loggedRun{result: result, resp: resp}
+	}
+	resp["run_id"] = runID
+	if result.Artifacts != nil {
+		a.Log.WriteFile(dir, "artifacts.json", result.Artifacts)
+	}
+	if result.Changes != nil {
+		a.Log.WriteFile(dir, "changes.json", result.Changes)
+	}
+	if result.Patch != "" {
+		a.Log.WritePatch(dir, result.Patch)
+	}
+	for i, att := range result.Attempts {
+		attResp := runResponse(att)
+		delete(attResp, "attempts")
+		attResp["attempt"] = i + 1
+		a.Log.WriteAttempt(dir, i+1, att.StdoutJS, att.Stderr, attResp)
+	}
+	a.Log.WriteAll(dir, loggedRequest(spec, req), resolvedLog{ToolSpec: spec, ResolvedEnv: result.Env}, result.StdoutJS, result.Stderr, resp)
+	return loggedRun{runID: runID, dir: dir, result: result, resp: resp}
+}
+
+// claimKey either makes this request the owner of key or returns the record
+// of the earlier run it should replay, waiting for that run if it is still in
+// flight. Keys whose run was abandoned are claimed afresh.
+func (a *API) claimKey(ctx context.Context, key, tool string, req runner.RunRequest) (idempotency.Record, bool, error) {
+	req.IdempotencyKey = ""
+	hash := idempotency.HashRequest(map[string]any{"tool": tool, "request": req})
+	for {
+		entry, owner, err := a.Idem.Begin(key, hash)
+		if err != nil || owner {
+			return idempotency.Record{}, owner, err
+		}
+		rec, err := entry.Wait(ctx)
+		if errors.Is(err, idempotency.ErrAbandoned) {
+			continue
+		}
+		return rec, false, err
+	}
+}
+
 func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(a.Cfg.Clients) == 0 && !loopbackHost(r.Host) {
+		writeJSON(w, 403, errBody("ERR_HOST_NOT_ALLOWED", "Host must be a loopback address when no clients are configured"))
+		return
+	}
 	if r.Method == http.MethodGet && r.URL.Path == "/v1/health" {
 		writeJSON(w, 200, map[string]any{"ok": true, "exit_code": 0})
 		return
 	}
+	if len(a.Cfg.Clients) > 0 {
+		c, ok := auth.Authenticate(a.Cfg.Clients, r.Header.Get("Authorization"))
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="musketeer-bridge"`)
+			writeJSON(w, 401, errBody("ERR_UNAUTHORIZED", "missing or invalid bearer token"))
+			return
+		}
+		r = r.WithContext(auth.WithClient(r.Context(), c.Name))
+	}
 	if r.Method == http.MethodGet && r.URL.Path == "/v1/tools" {
 		tools := []string{}
 		for n := range a.Reg.Tools {
 			tools = append(tools, n)
 		}
+		for n := range a.Reg.Pipelines {
+			tools = append(tools, n)
+		}
 		writeJSON(w, 200, map[string]any{"tools": tools, "exit_code": 0})
 		return
 	}
+	if r.Method == http.MethodPost && r.URL.Path == "/v1/runs/batch" {
+		a.handleBatch(w, r)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/v1/tools/") {
 		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/tools/"), "/")
 		name := parts[0]
-		spec, ok := a.Reg.Tools[name]
 		if len(parts) == 2 && parts[1] == "run" && r.Method == http.MethodPost {
-			var req runner.RunRequest
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				res := map[string]any{"exit_code": 40, "error": map[string]any{"code": "ERR_INVALID_INPUT", "message": "invalid json"}}
-				a.writeRunLog(map[string]any{"raw": "decode_error"}, nil, nil, "", res)
-				writeJSON(w, 400, res)
-				return
-			}
-			if !ok {
-				res := map[string]any{"exit_code": 40, "error": map[string]any{"code": "ERR_TOOL_NOT_FOUND", "message": "tool not found"}}
-				a.writeRunLog(req, nil, nil, "", res)
-				writeJSON(w, 404, res)
-				return
-			}
-			result := runner.Run(spec, req, a.Cfg.AllowlistedRoots, a.Cfg.EnvAllowlist, a.Cfg.MaxRuntimeMs)
-			resp := map[string]any{"exit_code": result.ExitCode, "ok": result.OK, "stdout": result.Stdout, "stderr": result.Stderr}
-			if result.StdoutJS != nil {
-				resp["stdout_json"] = result.StdoutJS
-			}
-			if result.Error != nil {
-				resp["error"] = result.Error
-			}
-			a.writeRunLog(req, spec, result.StdoutJS, result.Stderr, resp)
-			status := 200
-			if result.Error != nil {
-				status = 400
-				if result.ExitCode == 70 {
-					status = 500
-				}
-			}
-			writeJSON(w, status, resp)
+			a.handleRun(w, r, name)
 			return
 		}
+		if ps, ok := a.Reg.Pipelines[name]; ok && len(parts) == 1 && r.Method == http.MethodGet {
+			writeJSON(w, 200, map[string]any{"pipeline": ps, "exit_code": 0})
+			return
+		}
+		spec, ok := a.Reg.Tools[name]
 		if !ok {
 			res := map[string]any{"exit_code": 40, "error": map[string]any{"code": "ERR_TOOL_NOT_FOUND", "message": "tool not found"}}
 			writeJSON(w, 404, res)
@@ -2,6 +2,7 @@ package httpapi_test
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -22,9 +23,17 @@ func makeAPI(t *testing.T) *httpapi.API {
 	}
 }
 
+// newRequest is httptest.NewRequest addressed to the default listen
+// address, since the API rejects non-loopback Hosts without clients.
+func newRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Host = "127.0.0.1:18789"
+	return req
+}
+
 func TestHealthCheck(t *testing.T) {
 	api := makeAPI(t)
-	req := httptest.NewRequest(http.MethodGet, "/v1/health", nil)
+	req := newRequest(http.MethodGet, "/v1/health", nil)
 	w := httptest.NewRecorder()
 	api.ServeHTTP(w, req)
 
@@ -48,7 +57,7 @@ func TestHealthCheck(t *testing.T) {
 
 func TestInvalidJSONBodyReturns400(t *testing.T) {
 	api := makeAPI(t)
-	req := httptest.NewRequest(http.MethodPost, "/v1/tools/fake/run", strings.NewReader("not-json"))
+	req := newRequest(http.MethodPost, "/v1/tools/fake/run", strings.NewReader("not-json"))
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 	api.ServeHTTP(w, req)
@@ -74,7 +83,7 @@ func TestInvalidJSONBodyReturns400(t *testing.T) {
 
 func TestToolsListEmpty(t *testing.T) {
 	api := makeAPI(t)
-	req := httptest.NewRequest(http.MethodGet, "/v1/tools", nil)
+	req := newRequest(http.MethodGet, "/v1/tools", nil)
 	w := httptest.NewRecorder()
 	api.ServeHTTP(w, req)
 
@@ -99,7 +108,7 @@ func TestToolsListEmpty(t *testing.T) {
 
 func TestToolNotFound(t *testing.T) {
 	api := makeAPI(t)
-	req := httptest.NewRequest(http.MethodGet, "/v1/tools/does-not-exist", nil)
+	req := newRequest(http.MethodGet, "/v1/tools/does-not-exist", nil)
 	w := httptest.NewRecorder()
 	api.ServeHTTP(w, req)
 
@@ -122,7 +131,7 @@ func TestToolNotFound(t *testing.T) {
 func TestRunToolNotFoundReturns404(t *testing.T) {
 	api := makeAPI(t)
 	body := `{"version":"0.1.0","args":{},"cwd":"/tmp","env":{},"mode":"json","client":{"name":"test"}}`
-	req := httptest.NewRequest(http.MethodPost, "/v1/tools/does-not-exist/run", strings.NewReader(body))
+	req := newRequest(http.MethodPost, "/v1/tools/does-not-exist/run", strings.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 	api.ServeHTTP(w, req)
@@ -154,7 +163,7 @@ func TestResponseAlwaysIncludesExitCode(t *testing.T) {
 		{http.MethodGet, "/v1/tools/does-not-exist"},
 	}
 	for _, p := range paths {
-		req := httptest.NewRequest(p.method, p.path, nil)
+		req := newRequest(p.method, p.path, nil)
 		w := httptest.NewRecorder()
 		api.ServeHTTP(w, req)
 		var body map[string]any
@@ -166,3 +175,73 @@ func TestResponseAlwaysIncludesExitCode(t *testing.T) {
 		}
 	}
 }
+
+func TestBatchUnknownToolReturns404(t *testing.T) {
+	api := makeAPI(t)
+	body := `{"cwd":"/tmp","mode":"json","items":[{"tool":"does-not-exist","args":{}}]}`
+	req := newRequest(http.MethodPost, "/v1/runs/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	errObj, ok := resp["error"].(map[string]any)
+	if !ok || errObj["code"] != "ERR_TOOL_NOT_FOUND" {
+		t.Fatalf("expected ERR_TOOL_NOT_FOUND, got %v", resp)
+	}
+}
+
+func TestBatchRejectsUnknownStrategy(t *testing.T) {
+	api := makeAPI(t)
+	body := `{"cwd":"/tmp","mode":"json","strategy":"random","items":[{"tool":"x","args":{}}]}`
+	req := newRequest(http.MethodPost, "/v1/runs/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var resp map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["exit_code"] != float64(40) {
+		t.Fatalf("expected exit_code=40, got %v", resp["exit_code"])
+	}
+}
+
+func TestRejectsNonLoopbackHostWithoutClients(t *testing.T) {
+	api := makeAPI(t)
+	for host, want := range map[string]int{
+		"127.0.0.1:18789":     200,
+		"localhost:18789":     200,
+		"[::1]:18789":         200,
+		"localhost":           200,
+		"evil.example:18789":  403,
+		"192.168.1.10:18789":  403,
+		"127.0.0.1.nip.io:80": 403,
+	} {
+		req := newRequest(http.MethodGet, "/v1/tools", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Fatalf("Host %q: expected %d, got %d", host, want, w.Code)
+		}
+	}
+
+	api.Cfg.Clients = []config.Client{{Name: "ci", TokenSHA256: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}}
+	req := newRequest(http.MethodGet, "/v1/tools", nil)
+	req.Host = "bridge.internal:18789"
+	req.Header.Set("Authorization", "Bearer test")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected any Host to be accepted with a valid token, got %d", w.Code)
+	}
+}
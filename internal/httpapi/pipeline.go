@@ -0,0 +1,148 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"musketeer-bridge/internal/registry"
+	"musketeer-bridge/internal/runner"
+)
+
+// runPipeline executes the steps of ps in order as one run. Each step gets
+// its own run log linked to the pipeline's run. A step without a "when"
+// condition is skipped once an earlier step has failed.
+func (a *API) runPipeline(ctx context.Context, ps registry.PipelineSpec, req runner.RunRequest) loggedRun {
+	runID, dir, logErr := a.Log.NewRunDir()
+	parentID := runID
+	if logErr != nil {
+		parentID = ""
+	}
+	outputs := map[string]runner.RunResult{}
+	steps := []map[string]any{}
+	var failed *runner.RunResult
+	var last runner.RunResult
+	for _, st := range ps.Steps {
+		if !stepShouldRun(st, outputs, failed != nil) {
+			steps = append(steps, map[string]any{"id": st.ID, "tool": st.Tool, "skipped": true})
+			continue
+		}
+		args, err := stepArgs(st, req.Args, outputs)
+		var res runner.RunResult
+		var resp map[string]any
+		if err != nil {
+			res = runner.RunResult{ExitCode: 40, Error: &runner.ErrPayload{Code: "ERR_INVALID_INPUT", Message: fmt.Sprintf("step %s: %s", st.ID, err.Error())}}
+			resp = runResponse(res)
+		} else {
+			child := runner.RunRequest{Version: st.Version, Mode: req.Mode, Cwd: req.Cwd, Env: req.Env, Args: args, Client: req.Client, TimeoutMs: req.TimeoutMs}
+			lr := a.runAndLog(ctx, st.Tool, a.Reg.Tools[st.Tool], child, parentID, nil)
+			res, resp = lr.result, lr.resp
+		}
+		resp["id"], resp["tool"] = st.ID, st.Tool
+		steps = append(steps, resp)
+		outputs[st.ID] = res
+		last = res
+		if !res.OK && failed == nil {
+			failed = &res
+		}
+	}
+
+	result := runner.RunResult{OK: true, StdoutJS: last.StdoutJS}
+	if failed != nil {
+		result = runner.RunResult{ExitCode: failed.ExitCode, Error: failed.Error, HTTPStatus: failed.HTTPStatus}
+	}
+	resp := map[string]any{"exit_code": result.ExitCode, "ok": result.OK, "pipeline": ps.Name, "steps": steps}
+	if result.StdoutJS != nil {
+		resp["stdout_json"] = result.StdoutJS
+	}
+	if result.Error != nil {
+		resp["error"] = result.Error
+	}
+	if logErr != nil {
+		return loggedRun{result: result, resp: resp}
+	}
+	resp["run_id"] = runID
+	a.Log.WriteAll(dir, req, ps, result.StdoutJS, "", resp)
+	return loggedRun{runID: runID, dir: dir, result: result, resp: resp}
+}
+
+// pipelineRequestErr rejects request fields that steps do not inherit, so a
+// pipeline never silently runs differently from what the client asked for.
+// Steps always run against the real cwd, without stdin or streaming.
+func pipelineRequestErr(req runner.RunRequest) string {
+	switch {
+	case req.Workspace != "" || req.KeepScratch:
+		return "workspace and keep_scratch are not supported for pipelines"
+	case req.Stdin != nil:
+		return "stdin is not supported for pipelines"
+	case req.Stream:
+		return "stream is not supported for pipelines"
+	}
+	return ""
+}
+
+func stepShouldRun(st registry.PipelineStep, outputs map[string]runner.RunResult, failed bool) bool {
+	if st.When == nil {
+		return !failed
+	}
+	prev, ran := outputs[st.When.Step]
+	return ran && slices.Contains(st.When.ExitCodes, prev.ExitCode)
+}
+
+// stepArgs merges a step's static args with values mapped from the request
+// args or earlier steps' stdout_json.
+func stepArgs(st registry.PipelineStep, input map[string]interface{}, outputs map[string]runner.RunResult) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for k, v := range st.Args {
+		args[k] = v
+	}
+	for k, ref := range st.ArgsFrom {
+		var doc any = input
+		if ref.Step != "" {
+			prev, ok := outputs[ref.Step]
+			if !ok || prev.StdoutJS == nil {
+				return nil, fmt.Errorf("args_from %s: step %s has no stdout_json", k, ref.Step)
+			}
+			doc = prev.StdoutJS
+		}
+		v, ok := jsonPointer(doc, ref.Pointer)
+		if !ok {
+			return nil, fmt.Errorf("args_from %s: pointer %q not found", k, ref.Pointer)
+		}
+		args[k] = v
+	}
+	return args, nil
+}
+
+// jsonPointer resolves an RFC 6901 JSON pointer against a decoded JSON value.
+func jsonPointer(doc any, ptr string) (any, bool) {
+	if ptr == "" {
+		return doc, true
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, false
+	}
+	cur := doc
+	for _, tok := range strings.Split(ptr[1:], "/") {
+		tok = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+		switch v := cur.(type) {
+		case map[string]any:
+			next, ok := v[tok]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case []any:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			cur = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
@@ -0,0 +1,40 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// eventStream writes a streamed run as NDJSON: one {"type":"event"} line per
+// jsonl event as it arrives, then a final {"type":"result"} line. The status
+// is 200 once an event has been sent; otherwise it is the run's own status.
+type eventStream struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *eventStream) start(status int) {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", "application/x-ndjson")
+	s.w.WriteHeader(status)
+}
+
+func (s *eventStream) send(line int, event any) {
+	s.start(http.StatusOK)
+	s.write(map[string]any{"type": "event", "line": line, "event": event})
+}
+
+func (s *eventStream) finish(status int, resp map[string]any) {
+	s.start(status)
+	s.write(map[string]any{"type": "result", "result": resp})
+}
+
+func (s *eventStream) write(v any) {
+	_ = json.NewEncoder(s.w).Encode(v)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
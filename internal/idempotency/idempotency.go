@@ -0,0 +1,165 @@
+// Package idempotency remembers which run answered each idempotency key so
+// that retried requests get the original result instead of a second run.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrConflict means the key was already used with a different request body.
+var ErrConflict = errors.New("idempotency key reused with a different request")
+
+// ErrAbandoned means the run that owned the key ended without a usable log.
+var ErrAbandoned = errors.New("original run did not complete")
+
+// Record points at the run log that answered a key.
+type Record struct {
+	Key         string    `json:"key"`
+	RequestHash string    `json:"request_sha256"`
+	RunID       string    `json:"run_id"`
+	RunDir      string    `json:"run_dir"`
+	Status      int       `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Entry is a key that is running or has completed.
+type Entry struct {
+	done   chan struct{}
+	record Record
+	err    error
+}
+
+// Wait blocks until the owning run finishes and returns its record.
+func (e *Entry) Wait(ctx context.Context) (Record, error) {
+	select {
+	case <-e.done:
+		return e.record, e.err
+	case <-ctx.Done():
+		return Record{}, ctx.Err()
+	}
+}
+
+// Store keeps entries in memory and, when Dir is set, completed records on
+// disk so keys survive a restart. Keys expire TTL after they were first used.
+type Store struct {
+	Dir string
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// HashRequest is the body hash used to detect conflicting reuse of a key.
+func HashRequest(v any) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func keyFile(dir, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *Store) expired(created time.Time) bool {
+	return s.TTL > 0 && time.Since(created) > s.TTL
+}
+
+// Begin claims key for a request with the given hash. When owner is true the
+// caller must run the request and then call Finish or Abandon; otherwise the
+// returned entry belongs to an earlier run with the same key and body.
+func (s *Store) Begin(key, hash string) (e *Entry, owner bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = map[string]*Entry{}
+	}
+	for k, old := range s.entries {
+		if isDone(old) && s.expired(old.record.CreatedAt) {
+			delete(s.entries, k)
+		}
+	}
+	if old, ok := s.entries[key]; ok {
+		if old.record.RequestHash != hash {
+			return nil, false, ErrConflict
+		}
+		return old, false, nil
+	}
+	if rec, ok := s.load(key); ok {
+		if rec.RequestHash != hash {
+			return nil, false, ErrConflict
+		}
+		old := &Entry{done: make(chan struct{}), record: rec}
+		close(old.done)
+		s.entries[key] = old
+		return old, false, nil
+	}
+	e = &Entry{done: make(chan struct{}), record: Record{Key: key, RequestHash: hash, CreatedAt: time.Now().UTC()}}
+	s.entries[key] = e
+	return e, true, nil
+}
+
+func (s *Store) load(key string) (Record, bool) {
+	if s.Dir == "" {
+		return Record{}, false
+	}
+	b, err := os.ReadFile(keyFile(s.Dir, key))
+	if err != nil {
+		return Record{}, false
+	}
+	var rec Record
+	if err := json.Unmarshal(b, &rec); err != nil || rec.Key != key || s.expired(rec.CreatedAt) {
+		return Record{}, false
+	}
+	return rec, true
+}
+
+// Finish records which run answered key and wakes any waiters.
+func (s *Store) Finish(key, runID, runDir string, status int) {
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	e.record.RunID, e.record.RunDir, e.record.Status = runID, runDir, status
+	if s.Dir != "" {
+		if b, err := json.MarshalIndent(e.record, "", "  "); err == nil {
+			if os.MkdirAll(s.Dir, 0o755) == nil {
+				_ = os.WriteFile(keyFile(s.Dir, key), b, 0o644)
+			}
+		}
+	}
+	close(e.done)
+}
+
+// Abandon releases key without a result so that a retry runs the request again.
+func (s *Store) Abandon(key string) {
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if ok {
+		delete(s.entries, key)
+	}
+	s.mu.Unlock()
+	if ok {
+		e.err = ErrAbandoned
+		close(e.done)
+	}
+}
+
+func isDone(e *Entry) bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
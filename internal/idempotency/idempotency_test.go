@@ -0,0 +1,62 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBeginFinishReplay(t *testing.T) {
+	s := &Store{Dir: t.TempDir(), TTL: time.Hour}
+	_, owner, err := s.Begin("k1", "h1")
+	if err != nil || !owner {
+		t.Fatalf("expected first use to own the key, got %v %v", owner, err)
+	}
+	e, owner, err := s.Begin("k1", "h1")
+	if err != nil || owner {
+		t.Fatalf("expected retry to attach, got %v %v", owner, err)
+	}
+	go s.Finish("k1", "run-1", "/runs/run-1", 200)
+	rec, err := e.Wait(context.Background())
+	if err != nil || rec.RunID != "run-1" || rec.Status != 200 {
+		t.Fatalf("unexpected record %+v %v", rec, err)
+	}
+	if _, _, err := s.Begin("k1", "h2"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	restarted := &Store{Dir: s.Dir, TTL: time.Hour}
+	e, owner, err = restarted.Begin("k1", "h1")
+	if err != nil || owner {
+		t.Fatalf("expected persisted key after restart, got %v %v", owner, err)
+	}
+	if rec, _ := e.Wait(context.Background()); rec.RunDir != "/runs/run-1" {
+		t.Fatalf("unexpected persisted record %+v", rec)
+	}
+}
+
+func TestExpiredKeyRunsAgain(t *testing.T) {
+	s := &Store{Dir: t.TempDir(), TTL: time.Millisecond}
+	if _, owner, _ := s.Begin("k", "h"); !owner {
+		t.Fatal("expected owner")
+	}
+	s.Finish("k", "run-1", "/runs/run-1", 200)
+	time.Sleep(5 * time.Millisecond)
+	if _, owner, err := s.Begin("k", "other"); err != nil || !owner {
+		t.Fatalf("expected expired key to be reusable, got %v %v", owner, err)
+	}
+}
+
+func TestAbandonLetsRetryRun(t *testing.T) {
+	s := &Store{TTL: time.Hour}
+	s.Begin("k", "h")
+	e, _, _ := s.Begin("k", "h")
+	s.Abandon("k")
+	if _, err := e.Wait(context.Background()); !errors.Is(err, ErrAbandoned) {
+		t.Fatalf("expected ErrAbandoned, got %v", err)
+	}
+	if _, owner, _ := s.Begin("k", "h"); !owner {
+		t.Fatal("expected abandoned key to be claimable")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 )
 
@@ -38,3 +39,40 @@ func (l LogWriter) WriteAll(dir string, req any, resolved any, stdoutJSON any, s
 	_ = os.WriteFile(filepath.Join(dir, "stderr.txt"), []byte(stderr), 0o644)
 	_ = writeJSON(filepath.Join(dir, "result.json"), result)
 }
+
+// WriteAttempt records attempt n (1-based) of a retried run under
+// attempts/<n>/ in the run directory.
+func (l LogWriter) WriteAttempt(dir string, n int, stdoutJSON any, stderr string, result any) {
+	adir := filepath.Join(dir, "attempts", strconv.Itoa(n))
+	if err := os.MkdirAll(adir, 0o755); err != nil {
+		return
+	}
+	if stdoutJSON != nil {
+		_ = writeJSON(filepath.Join(adir, "stdout.json"), stdoutJSON)
+	}
+	_ = os.WriteFile(filepath.Join(adir, "stderr.txt"), []byte(stderr), 0o644)
+	_ = writeJSON(filepath.Join(adir, "result.json"), result)
+}
+
+// WriteFile writes v as name (for example artifacts.json) in a run directory.
+func (l LogWriter) WriteFile(dir, name string, v any) {
+	_ = writeJSON(filepath.Join(dir, name), v)
+}
+
+// WritePatch writes a scratch run's unified diff as patch.diff.
+func (l LogWriter) WritePatch(dir, patch string) {
+	_ = os.WriteFile(filepath.Join(dir, "patch.diff"), []byte(patch), 0o644)
+}
+
+// ReadResult loads result.json from a run directory.
+func (l LogWriter) ReadResult(dir string) (map[string]any, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "result.json"))
+	if err != nil {
+		return nil, err
+	}
+	var res map[string]any
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,7 @@
+// Package pty allocates pseudo-terminals for tools that need a TTY.
+package pty
+
+import "errors"
+
+// ErrUnavailable means the host cannot allocate a pseudo-terminal.
+var ErrUnavailable = errors.New("pseudo-terminal unavailable")
@@ -0,0 +1,58 @@
+//go:build linux
+
+package pty
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Open allocates a pseudo-terminal with the given window size. The caller
+// gives slave to the child as its terminal and reads output from master.
+func Open(rows, cols int) (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+	var n uint32
+	unlock := int32(0)
+	if err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err == nil {
+		err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	}
+	if err == nil {
+		slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err == nil {
+		ws := struct{ row, col, x, y uint16 }{uint16(rows), uint16(cols), 0, 0}
+		err = ioctl(slave, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+	}
+	if err != nil {
+		master.Close()
+		if slave != nil {
+			slave.Close()
+		}
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+	return master, slave, nil
+}
+
+// ioctl goes through SyscallConn so that f stays in non-blocking mode and
+// keeps supporting read deadlines.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package pty
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestOpenSetsWindowSize(t *testing.T) {
+	master, slave, err := Open(30, 100)
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+	var ws struct{ row, col, x, y uint16 }
+	if err := ioctl(slave, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		t.Fatal(err)
+	}
+	if ws.row != 30 || ws.col != 100 {
+		t.Fatalf("window size = %dx%d, want 30x100", ws.row, ws.col)
+	}
+}
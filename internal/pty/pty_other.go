@@ -0,0 +1,10 @@
+//go:build !linux
+
+package pty
+
+import "os"
+
+// Open is only implemented on Linux.
+func Open(rows, cols int) (master, slave *os.File, err error) {
+	return nil, nil, ErrUnavailable
+}
@@ -5,14 +5,23 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 )
 
+// ArgMap maps one request arg to argv. Pattern (matched against the whole
+// value) and MaxLength constrain string values, Min and Max numbers; string
+// values starting with "-" are rejected unless AllowLeadingDash is set.
 type ArgMap struct {
-	Input    string `json:"input"`
-	Flag     string `json:"flag"`
-	Kind     string `json:"kind"`
-	Repeated bool   `json:"repeated"`
+	Input            string   `json:"input"`
+	Flag             string   `json:"flag"`
+	Kind             string   `json:"kind"`
+	Repeated         bool     `json:"repeated"`
+	Pattern          string   `json:"pattern,omitempty"`
+	MaxLength        int      `json:"max_length,omitempty"`
+	Min              *float64 `json:"min,omitempty"`
+	Max              *float64 `json:"max,omitempty"`
+	AllowLeadingDash bool     `json:"allow_leading_dash,omitempty"`
 }
 
 type ExecSpec struct {
@@ -21,20 +30,129 @@ type ExecSpec struct {
 	WorkingDir string   `json:"working_dir"`
 }
 
+// SandboxSpec opts a tool into process confinement. The working directory is
+// always writable; WritePaths adds more, relative to it unless absolute.
+type SandboxSpec struct {
+	WritePaths   []string `json:"write_paths,omitempty"`
+	AllowNetwork bool     `json:"allow_network,omitempty"`
+}
+
+// EnvSpec adjusts the daemon env_allowlist for one tool. Allow adds keys,
+// Deny removes them, and Set injects fixed values that always win.
+type EnvSpec struct {
+	Allow []string          `json:"allow,omitempty"`
+	Set   map[string]string `json:"set,omitempty"`
+	Deny  []string          `json:"deny,omitempty"`
+}
+
+// SecretRef injects one secret into the tool's environment as Name. Source is
+// a dotenv file or a file-per-secret directory under secrets_dir; Key
+// defaults to Name.
+type SecretRef struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Key    string `json:"key,omitempty"`
+}
+
+// RetrySpec reruns a failed tool. An attempt is retried when its exit code is
+// in ExitCodes or its error code is in ErrorCodes; BackoffMs doubles after
+// each retry.
+type RetrySpec struct {
+	MaxAttempts int      `json:"max_attempts"`
+	BackoffMs   int      `json:"backoff_ms,omitempty"`
+	ExitCodes   []int    `json:"exit_codes,omitempty"`
+	ErrorCodes  []string `json:"error_codes,omitempty"`
+}
+
+// ExitCodeSpec describes what one tool exit code means. An OK code counts as
+// success even if non-zero; otherwise Code and Message replace the generic
+// ERR_EXEC_FAILED. HTTPStatus, if set, overrides the response status.
+type ExitCodeSpec struct {
+	OK         bool   `json:"ok,omitempty"`
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message,omitempty"`
+	HTTPStatus int    `json:"http_status,omitempty"`
+}
+
+// ChangeSpec turns on change tracking of the cwd tree. Changed files outside
+// WriteScope (globs or directories relative to cwd, plus Outputs) are
+// reported as warnings, or fail the run when OnViolation is "fail".
+type ChangeSpec struct {
+	WriteScope    []string `json:"write_scope,omitempty"`
+	OnViolation   string   `json:"on_violation,omitempty"`
+	MaxFileBytes  int64    `json:"max_file_bytes,omitempty"`
+	MaxTotalBytes int64    `json:"max_total_bytes,omitempty"`
+	MaxFiles      int      `json:"max_files,omitempty"`
+}
+
+// TTYSize is the window size of a tool's pseudo-terminal.
+type TTYSize struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
 type ToolSpec struct {
-	Name        string   `json:"name"`
-	Version     string   `json:"version"`
-	Description string   `json:"description"`
-	JsonMode    bool     `json:"json_mode"`
-	Exec        ExecSpec `json:"exec"`
+	Name           string               `json:"name"`
+	Version        string               `json:"version"`
+	Description    string               `json:"description"`
+	JsonMode       bool                 `json:"json_mode"`
+	Exec           ExecSpec             `json:"exec"`
+	TimeoutMs      int                  `json:"timeout_ms,omitempty"`
+	Stdin          string               `json:"stdin,omitempty"`
+	RedactStdin    bool                 `json:"redact_stdin,omitempty"`
+	Env            *EnvSpec             `json:"env,omitempty"`
+	Secrets        []SecretRef          `json:"secrets,omitempty"`
+	MaxConcurrency int                  `json:"max_concurrency,omitempty"`
+	Lock           string               `json:"lock,omitempty"`
+	Sandbox        *SandboxSpec         `json:"sandbox,omitempty"`
+	Retry          *RetrySpec           `json:"retry,omitempty"`
+	ExitCodes      map[int]ExitCodeSpec `json:"exit_codes,omitempty"`
+	OutputFormat   string               `json:"output_format,omitempty"`
+	Outputs        []string             `json:"outputs,omitempty"`
+	TrackChanges   *ChangeSpec          `json:"track_changes,omitempty"`
+	TTY            bool                 `json:"tty,omitempty"`
+	TTYSize        *TTYSize             `json:"tty_size,omitempty"`
+	StripANSI      bool                 `json:"strip_ansi,omitempty"`
+	CwdPolicy      string               `json:"cwd_policy,omitempty"`
+}
+
+// StepRef points into the stdout_json of an earlier step with a JSON
+// pointer. An empty Step refers to the args of the pipeline run request.
+type StepRef struct {
+	Step    string `json:"step,omitempty"`
+	Pointer string `json:"pointer"`
+}
+
+// StepCondition runs a step only if Step ran and exited with one of ExitCodes.
+type StepCondition struct {
+	Step      string `json:"step"`
+	ExitCodes []int  `json:"exit_codes"`
+}
+
+type PipelineStep struct {
+	ID       string                 `json:"id"`
+	Tool     string                 `json:"tool"`
+	Version  string                 `json:"version,omitempty"`
+	Args     map[string]interface{} `json:"args,omitempty"`
+	ArgsFrom map[string]StepRef     `json:"args_from,omitempty"`
+	When     *StepCondition         `json:"when,omitempty"`
+}
+
+// PipelineSpec is a pipeline.json entry: ordered tool steps run as one run.
+type PipelineSpec struct {
+	Name        string         `json:"name"`
+	Version     string         `json:"version"`
+	Description string         `json:"description"`
+	Steps       []PipelineStep `json:"steps"`
 }
 
 type Registry struct {
-	Tools map[string]ToolSpec
+	Tools     map[string]ToolSpec
+	Pipelines map[string]PipelineSpec
 }
 
 func Load(base string) (Registry, error) {
-	reg := Registry{Tools: map[string]ToolSpec{}}
+	reg := Registry{Tools: map[string]ToolSpec{}, Pipelines: map[string]PipelineSpec{}}
 	toolsDir := filepath.Join(base, "tools")
 	entries, err := os.ReadDir(toolsDir)
 	if err != nil {
@@ -61,6 +179,18 @@ func Load(base string) (Registry, error) {
 			continue
 		}
 		latest := names[len(names)-1]
+		pp := filepath.Join(vdir, latest, "pipeline.json")
+		if b, err := os.ReadFile(pp); err == nil {
+			var ps PipelineSpec
+			if err := json.Unmarshal(b, &ps); err != nil {
+				return reg, errors.New("ERR_REGISTRY_INVALID")
+			}
+			if ps.Name == "" || ps.Version == "" || ps.Description == "" || len(ps.Steps) == 0 {
+				return reg, errors.New("ERR_REGISTRY_INVALID")
+			}
+			reg.Pipelines[name] = ps
+			continue
+		}
 		p := filepath.Join(vdir, latest, "tool.json")
 		b, err := os.ReadFile(p)
 		if err != nil {
@@ -73,7 +203,76 @@ func Load(base string) (Registry, error) {
 		if t.Name == "" || t.Version == "" || t.Description == "" || len(t.Exec.Argv) == 0 {
 			return reg, errors.New("ERR_REGISTRY_INVALID")
 		}
+		for _, m := range t.Exec.ArgsMap {
+			if _, err := regexp.Compile(m.Pattern); err != nil || m.MaxLength < 0 || (m.Min != nil && m.Max != nil && *m.Min > *m.Max) {
+				return reg, errors.New("ERR_REGISTRY_INVALID")
+			}
+		}
+		if t.Lock != "" && t.Lock != "cwd" && t.Lock != "root" {
+			return reg, errors.New("ERR_REGISTRY_INVALID")
+		}
+		if t.OutputFormat != "" && t.OutputFormat != "json" && t.OutputFormat != "jsonl" {
+			return reg, errors.New("ERR_REGISTRY_INVALID")
+		}
+		for _, g := range t.Outputs {
+			if _, err := filepath.Match(g, ""); err != nil || !filepath.IsLocal(g) {
+				return reg, errors.New("ERR_REGISTRY_INVALID")
+			}
+		}
+		if tc := t.TrackChanges; tc != nil && ((tc.OnViolation != "" && tc.OnViolation != "warn" && tc.OnViolation != "fail") || tc.MaxFileBytes < 0 || tc.MaxTotalBytes < 0 || tc.MaxFiles < 0) {
+			return reg, errors.New("ERR_REGISTRY_INVALID")
+		}
+		if t.TTY && (t.JsonMode || t.OutputFormat == "jsonl" || (t.Stdin != "" && t.Stdin != "none")) {
+			return reg, errors.New("ERR_REGISTRY_INVALID")
+		}
+		if ts := t.TTYSize; ts != nil && (ts.Rows < 1 || ts.Cols < 1 || ts.Rows > 0xffff || ts.Cols > 0xffff) {
+			return reg, errors.New("ERR_REGISTRY_INVALID")
+		}
+		switch t.CwdPolicy {
+		case "", "required", "optional":
+		case "none":
+			if t.Lock != "" || len(t.Outputs) > 0 || t.TrackChanges != nil || t.Exec.WorkingDir != "" {
+				return reg, errors.New("ERR_REGISTRY_INVALID")
+			}
+		default:
+			return reg, errors.New("ERR_REGISTRY_INVALID")
+		}
+		if t.Retry != nil && (t.Retry.MaxAttempts < 1 || t.Retry.BackoffMs < 0) {
+			return reg, errors.New("ERR_REGISTRY_INVALID")
+		}
+		for code, ec := range t.ExitCodes {
+			if code == 0 || (ec.HTTPStatus != 0 && (ec.HTTPStatus < 200 || ec.HTTPStatus > 599)) {
+				return reg, errors.New("ERR_REGISTRY_INVALID")
+			}
+		}
 		reg.Tools[name] = t
 	}
+	for _, ps := range reg.Pipelines {
+		if !validPipeline(ps, reg.Tools) {
+			return reg, errors.New("ERR_REGISTRY_INVALID")
+		}
+	}
 	return reg, nil
 }
+
+// validPipeline checks that every step names a loaded tool (at the pinned
+// version, if any) and only refers to earlier steps.
+func validPipeline(ps PipelineSpec, tools map[string]ToolSpec) bool {
+	seen := map[string]bool{}
+	for _, st := range ps.Steps {
+		t, ok := tools[st.Tool]
+		if st.ID == "" || seen[st.ID] || !ok || (st.Version != "" && st.Version != t.Version) {
+			return false
+		}
+		for _, ref := range st.ArgsFrom {
+			if ref.Step != "" && !seen[ref.Step] {
+				return false
+			}
+		}
+		if st.When != nil && !seen[st.When.Step] {
+			return false
+		}
+		seen[st.ID] = true
+	}
+	return true
+}
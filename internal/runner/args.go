@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"musketeer-bridge/internal/registry"
+)
+
+// FieldError is one arg that failed its args_mapping constraints. Rule names
+// the constraint: type, control, leading_dash, max_length, pattern, min or max.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidateArgs checks request args against their args_mapping constraints
+// before anything is executed. Each element of a list arg is checked on its
+// own. Every failing arg is reported in one ERR_INVALID_INPUT result.
+func ValidateArgs(spec registry.ToolSpec, args map[string]interface{}) *RunResult {
+	var fields []FieldError
+	var names []string
+	for _, m := range spec.Exec.ArgsMap {
+		v, ok := args[m.Input]
+		if !ok {
+			continue
+		}
+		vals := []interface{}{v}
+		if list, ok := v.([]interface{}); ok {
+			vals = list
+		}
+		for _, x := range vals {
+			if fe := checkArg(m, x); fe != nil {
+				fields = append(fields, *fe)
+				names = append(names, m.Input)
+				break
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	res := codeErr("ERR_INVALID_INPUT", "invalid args: "+strings.Join(names, ", "), 40)
+	res.Error.Fields = fields
+	return &res
+}
+
+// checkArg applies m's constraints to one value. Objects and nested lists
+// are never accepted, since argv would carry their Go formatting. Numbers are
+// checked against min and max, then like strings in their argv form. An arg
+// with min or max only takes numbers, and one with pattern or max_length only
+// takes strings or numbers.
+func checkArg(m registry.ArgMap, v interface{}) *FieldError {
+	bad := func(rule, format string, a ...any) *FieldError {
+		return &FieldError{Field: m.Input, Rule: rule, Message: fmt.Sprintf(format, a...)}
+	}
+	var x float64
+	var text string
+	switch n := v.(type) {
+	case map[string]interface{}, []interface{}:
+		return bad("type", "must be a string, number or boolean")
+	case float64:
+		x, text = n, strconv.FormatFloat(n, 'f', -1, 64)
+	case json.Number:
+		f, err := n.Float64()
+		if err != nil {
+			return bad("type", "must be a number")
+		}
+		x, text = f, n.String()
+	case string:
+		if m.Min != nil || m.Max != nil {
+			return bad("type", "must be a number")
+		}
+		return checkText(m, n, bad)
+	default:
+		if m.Min != nil || m.Max != nil {
+			return bad("type", "must be a number")
+		}
+		if m.Pattern != "" || m.MaxLength > 0 {
+			return bad("type", "must be a string")
+		}
+		return nil
+	}
+	if m.Min != nil && x < *m.Min {
+		return bad("min", "must be at least %v", *m.Min)
+	}
+	if m.Max != nil && x > *m.Max {
+		return bad("max", "must be at most %v", *m.Max)
+	}
+	return checkText(m, text, bad)
+}
+
+// checkText applies the string rules to s as it would appear in argv: no NUL
+// bytes or newlines, no leading "-" unless m allows it, then max_length and
+// pattern.
+func checkText(m registry.ArgMap, s string, bad func(rule, format string, a ...any) *FieldError) *FieldError {
+	if strings.ContainsAny(s, "\x00\n\r") {
+		return bad("control", "must not contain NUL bytes or newlines")
+	}
+	if strings.HasPrefix(s, "-") && !m.AllowLeadingDash {
+		return bad("leading_dash", `must not start with "-"`)
+	}
+	if m.MaxLength > 0 && utf8.RuneCountInString(s) > m.MaxLength {
+		return bad("max_length", "must be at most %d characters", m.MaxLength)
+	}
+	if m.Pattern != "" {
+		re, err := regexp.Compile(`^(?:` + m.Pattern + `)$`)
+		if err != nil || !re.MatchString(s) {
+			return bad("pattern", "must match %q", m.Pattern)
+		}
+	}
+	return nil
+}
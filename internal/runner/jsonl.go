@@ -0,0 +1,81 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// LineError reports the first stdout line of a jsonl run that is not a
+// single JSON object. Line is 1-based.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("stdout line %d is not a JSON object: %v", e.Line, e.Err)
+}
+
+// ParseJSONLines parses JSON Lines output into one object per non-blank line.
+func ParseJSONLines(s string) ([]any, error) {
+	events := []any{}
+	for i, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		obj, err := ParseOneJSONObject(line)
+		if err != nil {
+			return nil, &LineError{Line: i + 1, Err: err}
+		}
+		events = append(events, obj)
+	}
+	return events, nil
+}
+
+// eventWriter captures stdout like a bytes.Buffer and passes each complete
+// line that parse accepts to fn as soon as it is written.
+type eventWriter struct {
+	buf     *bytes.Buffer
+	parse   func(line []byte) (any, bool)
+	fn      func(line int, event any)
+	pending []byte
+	line    int
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.emit(w.pending[:i])
+		w.pending = w.pending[i+1:]
+	}
+}
+
+// flush emits a final line that was not newline-terminated.
+func (w *eventWriter) flush() {
+	if len(w.pending) > 0 {
+		w.emit(w.pending)
+		w.pending = nil
+	}
+}
+
+func (w *eventWriter) emit(b []byte) {
+	w.line++
+	if ev, ok := w.parse(b); ok {
+		w.fn(w.line, ev)
+	}
+}
+
+// jsonlEvent accepts a non-blank line holding one JSON object.
+func jsonlEvent(b []byte) (any, bool) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, false
+	}
+	obj, err := ParseOneJSONObject(string(b))
+	return obj, err == nil
+}
@@ -6,60 +6,426 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"musketeer-bridge/internal/artifacts"
+	"musketeer-bridge/internal/config"
+	"musketeer-bridge/internal/pty"
 	"musketeer-bridge/internal/registry"
+	"musketeer-bridge/internal/sandbox"
+	"musketeer-bridge/internal/secrets"
+	"musketeer-bridge/internal/workspace"
 )
 
 type RunRequest struct {
-	Version string                 `json:"version,omitempty"`
-	Mode    string                 `json:"mode"`
-	Cwd     string                 `json:"cwd"`
-	Env     map[string]string      `json:"env,omitempty"`
-	Args    map[string]interface{} `json:"args"`
-	Client  map[string]interface{} `json:"client,omitempty"`
+	Version        string                 `json:"version,omitempty"`
+	Mode           string                 `json:"mode"`
+	Cwd            string                 `json:"cwd"`
+	Env            map[string]string      `json:"env,omitempty"`
+	Args           map[string]interface{} `json:"args"`
+	Client         map[string]interface{} `json:"client,omitempty"`
+	TimeoutMs      int                    `json:"timeout_ms,omitempty"`
+	Stdin          any                    `json:"stdin,omitempty"`
+	IdempotencyKey string                 `json:"idempotency_key,omitempty"`
+	Stream         bool                   `json:"stream,omitempty"`
+	Workspace      string                 `json:"workspace,omitempty"`
+	KeepScratch    bool                   `json:"keep_scratch,omitempty"`
+}
+
+// Options is the daemon-level policy applied to every run, plus an optional
+// OnEvent hook that receives each parsed line of a jsonl run as it arrives.
+type Options struct {
+	Roots         []config.Root
+	EnvAllow      []string
+	TimeoutMs     int
+	MaxStdinBytes int
+	SecretsDir    string
+	ScratchDir    string
+	OnEvent       func(line int, event any)
+	// Confine, if set, sandboxes every run so it can write only beneath
+	// this directory and the temp dir. ReadOnly paths are never writable.
+	Confine  string
+	ReadOnly []string
 }
 
 type RunResult struct {
-	OK       bool        `json:"ok"`
-	ExitCode int         `json:"exit_code"`
-	Error    *ErrPayload `json:"error,omitempty"`
-	Stdout   string      `json:"stdout,omitempty"`
-	Stderr   string      `json:"stderr,omitempty"`
-	StdoutJS any         `json:"stdout_json,omitempty"`
+	OK          bool                 `json:"ok"`
+	ExitCode    int                  `json:"exit_code"`
+	Error       *ErrPayload          `json:"error,omitempty"`
+	Stdout      string               `json:"stdout,omitempty"`
+	Stderr      string               `json:"stderr,omitempty"`
+	StdoutJS    any                  `json:"stdout_json,omitempty"`
+	Usage       *Usage               `json:"usage,omitempty"`
+	TimeoutMs   int                  `json:"timeout_ms"`
+	QueueWaitMs int64                `json:"queue_wait_ms"`
+	LockWaitMs  int64                `json:"lock_wait_ms"`
+	Env         *EnvResolution       `json:"-"`
+	Attempts    []RunResult          `json:"-"`
+	HTTPStatus  int                  `json:"-"`
+	Artifacts   []artifacts.Artifact `json:"-"`
+	Changes     []artifacts.Artifact `json:"-"`
+	Warnings    []ErrPayload         `json:"-"`
+	Patch       string               `json:"-"`
+	ScratchDir  string               `json:"-"`
+}
+
+// EnvVar names one variable the process received and where its value came from:
+// "daemon", "request", "tool" or "secret".
+type EnvVar struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// EnvResolution reports which variables a tool process got. Values are
+// deliberately omitted.
+type EnvResolution struct {
+	Passed  []EnvVar `json:"passed"`
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// Usage is the resource accounting for one tool process, taken from its rusage.
+type Usage struct {
+	WallMs      int64 `json:"wall_ms"`
+	UserCPUMs   int64 `json:"user_cpu_ms"`
+	SystemCPUMs int64 `json:"system_cpu_ms"`
+	MaxRSSKB    int64 `json:"max_rss_kb"`
+	StdoutBytes int64 `json:"stdout_bytes"`
+	StderrBytes int64 `json:"stderr_bytes"`
 }
 
 type ErrPayload struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+	// Fields lists the args that failed their constraints.
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 func codeErr(code, msg string, exit int) RunResult {
 	return RunResult{OK: false, ExitCode: exit, Error: &ErrPayload{Code: code, Message: msg}}
 }
 
-func IsWithinRoots(cwd string, roots []string) bool {
+// IsWithinRoots returns the most specific allowlisted root containing cwd,
+// with its Path symlink-resolved. cwd is not allowed if it lies beneath one
+// of that root's deny_subpaths.
+func IsWithinRoots(cwd string, roots []config.Root) (config.Root, bool) {
 	realCwd, err := filepath.EvalSymlinks(cwd)
 	if err != nil {
-		return false
+		return config.Root{}, false
 	}
 	realCwd, _ = filepath.Abs(realCwd)
+	return rootFor(realCwd, roots)
+}
+
+// rootFor is IsWithinRoots for an already symlink-resolved absolute path.
+func rootFor(real string, roots []config.Root) (config.Root, bool) {
+	var best config.Root
+	found := false
 	for _, r := range roots {
-		rr, err := filepath.EvalSymlinks(r)
+		rr, err := filepath.EvalSymlinks(r.Path)
 		if err != nil {
 			continue
 		}
 		rr, _ = filepath.Abs(rr)
-		if strings.HasPrefix(realCwd, rr+string(os.PathSeparator)) || realCwd == rr {
-			return true
+		if within(real, rr) && (!found || len(rr) > len(best.Path)) {
+			best, found = r, true
+			best.Path = rr
 		}
 	}
-	return false
+	if !found {
+		return config.Root{}, false
+	}
+	for _, d := range best.DenySubpaths {
+		if !filepath.IsAbs(d) {
+			d = filepath.Join(best.Path, d)
+		}
+		if rd, err := filepath.EvalSymlinks(d); err == nil {
+			d = rd
+		}
+		if within(real, filepath.Clean(d)) {
+			return config.Root{}, false
+		}
+	}
+	return best, true
+}
+
+// evalPathPrefix resolves symlinks in the longest existing prefix of the
+// absolute path p and appends the rest, so paths a tool is about to create
+// can be checked too. A dangling symlink is followed to its target, which is
+// resolved the same way: the tool would write through it.
+func evalPathPrefix(p string) (string, error) {
+	rest := ""
+	for links := 0; ; {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if fi, lerr := os.Lstat(p); lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if links++; links > 40 {
+				return "", errors.New("too many levels of symbolic links")
+			}
+			target, err := os.Readlink(p)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				dir, err := filepath.EvalSymlinks(filepath.Dir(p))
+				if err != nil {
+					return "", err
+				}
+				target = filepath.Join(dir, target)
+			}
+			p = filepath.Clean(target)
+			continue
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// ResolvePathArgs returns args with every value mapped by a "path" kind
+// argument replaced by its absolute, symlink-resolved path, plus the
+// read_only roots those paths fall in. Relative values are taken relative to
+// cwd. A path outside roots, under a deny_subpaths entry or in a root whose
+// tools list excludes spec is an ERR_PATH_NOT_ALLOWLISTED error result.
+func ResolvePathArgs(spec registry.ToolSpec, args map[string]interface{}, cwd string, roots []config.Root) (map[string]interface{}, []string, *RunResult) {
+	var out map[string]interface{}
+	var readOnly []string
+	for _, m := range spec.Exec.ArgsMap {
+		v, ok := args[m.Input]
+		if m.Kind != "path" || !ok {
+			continue
+		}
+		if out == nil {
+			out = maps.Clone(args)
+		}
+		resolve := func(x interface{}) (string, *RunResult) {
+			s, ok := x.(string)
+			if !ok || s == "" {
+				res := codeErr("ERR_INVALID_INPUT", fmt.Sprintf("arg %q must be a non-empty path string", m.Input), 40)
+				return "", &res
+			}
+			if !filepath.IsAbs(s) {
+				s = filepath.Join(cwd, s)
+			}
+			real, err := evalPathPrefix(filepath.Clean(s))
+			var root config.Root
+			if err == nil {
+				root, ok = rootFor(real, roots)
+			}
+			if err != nil || !ok {
+				res := codeErr("ERR_PATH_NOT_ALLOWLISTED", fmt.Sprintf("arg %q is not in allowlisted roots", m.Input), 40)
+				return "", &res
+			}
+			if len(root.Tools) > 0 && !slices.Contains(root.Tools, spec.Name) {
+				res := codeErr("ERR_PATH_NOT_ALLOWLISTED", fmt.Sprintf("arg %q is in a root that does not allow this tool", m.Input), 40)
+				return "", &res
+			}
+			if root.ReadOnly && !slices.Contains(readOnly, root.Path) {
+				readOnly = append(readOnly, root.Path)
+			}
+			return real, nil
+		}
+		if list, ok := v.([]interface{}); ok {
+			paths := make([]interface{}, len(list))
+			for i, x := range list {
+				p, res := resolve(x)
+				if res != nil {
+					return nil, nil, res
+				}
+				paths[i] = p
+			}
+			out[m.Input] = paths
+			continue
+		}
+		p, res := resolve(v)
+		if res != nil {
+			return nil, nil, res
+		}
+		out[m.Input] = p
+	}
+	if out == nil {
+		return args, readOnly, nil
+	}
+	return out, readOnly, nil
+}
+
+// within reports whether path p is dir or lies beneath it.
+func within(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(os.PathSeparator))+string(os.PathSeparator))
+}
+
+// LockPath is the path a run of spec must hold the workspace lock on, or ""
+// when the tool declares no lock or cwd is not allowlisted (Run rejects it).
+func LockPath(spec registry.ToolSpec, cwd string, roots []config.Root) string {
+	root, ok := IsWithinRoots(cwd, roots)
+	if !ok {
+		return ""
+	}
+	switch spec.Lock {
+	case "cwd":
+		p, _ := filepath.EvalSymlinks(cwd)
+		p, _ = filepath.Abs(p)
+		return p
+	case "root":
+		return root.Path
+	}
+	return ""
+}
+
+// ResolveWorkingDir expands spec.Exec.WorkingDir against the request cwd.
+// Supported placeholders are {cwd} and {git_root}; relative results are
+// joined onto cwd. An empty working_dir means cwd itself.
+func ResolveWorkingDir(spec registry.ToolSpec, cwd string) (string, error) {
+	wd := spec.Exec.WorkingDir
+	if wd == "" {
+		return cwd, nil
+	}
+	if strings.Contains(wd, "{cwd}") {
+		wd = strings.ReplaceAll(wd, "{cwd}", cwd)
+	}
+	if strings.Contains(wd, "{git_root}") {
+		root, err := gitRoot(cwd)
+		if err != nil {
+			return "", err
+		}
+		wd = strings.ReplaceAll(wd, "{git_root}", root)
+	}
+	if i := strings.Index(wd, "{"); i >= 0 && strings.Contains(wd[i:], "}") {
+		return "", fmt.Errorf("unknown placeholder in working_dir %q", spec.Exec.WorkingDir)
+	}
+	if !filepath.IsAbs(wd) {
+		wd = filepath.Join(cwd, wd)
+	}
+	return filepath.Clean(wd), nil
+}
+
+func gitRoot(cwd string) (string, error) {
+	dir, err := filepath.Abs(cwd)
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", errors.New("no git repository above cwd")
+		}
+		dir = parent
+	}
+}
+
+// StdinBytes encodes req.Stdin according to the tool's stdin mode: "raw"
+// takes a string verbatim, "json" takes any JSON value (or a string holding
+// JSON text), and "none" (the default) rejects stdin. A nil result means the
+// process gets no stdin.
+func StdinBytes(spec registry.ToolSpec, req RunRequest, maxBytes int) ([]byte, error) {
+	if req.Stdin == nil {
+		return nil, nil
+	}
+	var b []byte
+	switch spec.Stdin {
+	case "", "none":
+		return nil, errors.New("tool does not accept stdin")
+	case "raw":
+		str, ok := req.Stdin.(string)
+		if !ok {
+			return nil, errors.New("stdin must be a string for raw stdin tools")
+		}
+		b = []byte(str)
+	case "json":
+		if str, ok := req.Stdin.(string); ok {
+			if !json.Valid([]byte(str)) {
+				return nil, errors.New("stdin is not valid JSON")
+			}
+			b = []byte(str)
+		} else {
+			enc, err := json.Marshal(req.Stdin)
+			if err != nil {
+				return nil, err
+			}
+			b = enc
+		}
+	default:
+		return nil, fmt.Errorf("unknown stdin mode %q", spec.Stdin)
+	}
+	if maxBytes > 0 && len(b) > maxBytes {
+		return nil, fmt.Errorf("stdin exceeds max_stdin_bytes (%d)", maxBytes)
+	}
+	return b, nil
+}
+
+// ResolveEnv builds the process environment from the daemon allowlist plus
+// the tool's env policy. Request values override daemon values for allowed
+// keys; tool "set" values override both, and secrets override everything.
+// Disallowed request keys are dropped.
+func ResolveEnv(spec registry.ToolSpec, reqEnv map[string]string, envAllow []string, secretVals map[string]string) ([]string, EnvResolution) {
+	allow := map[string]bool{}
+	for _, k := range envAllow {
+		allow[k] = true
+	}
+	if spec.Env != nil {
+		for _, k := range spec.Env.Allow {
+			allow[k] = true
+		}
+		for _, k := range spec.Env.Deny {
+			delete(allow, k)
+		}
+	}
+	vals := map[string]string{}
+	src := map[string]string{}
+	for k := range allow {
+		if v, ok := os.LookupEnv(k); ok {
+			vals[k], src[k] = v, "daemon"
+		}
+	}
+	res := EnvResolution{Passed: []EnvVar{}}
+	for k, v := range reqEnv {
+		if allow[k] {
+			vals[k], src[k] = v, "request"
+		} else {
+			res.Dropped = append(res.Dropped, k)
+		}
+	}
+	if spec.Env != nil {
+		for k, v := range spec.Env.Set {
+			vals[k], src[k] = v, "tool"
+		}
+	}
+	for k, v := range secretVals {
+		vals[k], src[k] = v, "secret"
+	}
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sort.Strings(res.Dropped)
+	env := make([]string, 0, len(keys))
+	for _, k := range keys {
+		env = append(env, k+"="+vals[k])
+		res.Passed = append(res.Passed, EnvVar{Name: k, Source: src[k]})
+	}
+	return env, res
 }
 
 func BuildArgv(spec registry.ToolSpec, req RunRequest) []string {
@@ -110,54 +476,576 @@ func ParseOneJSONObject(s string) (any, error) {
 	return v, nil
 }
 
-func Run(spec registry.ToolSpec, req RunRequest, roots []string, envAllow []string, timeoutMs int) RunResult {
-	if !IsWithinRoots(req.Cwd, roots) {
-		return codeErr("ERR_CWD_NOT_ALLOWLISTED", "cwd is not in allowlisted roots", 40)
+// EffectiveTimeoutMs is the smallest positive timeout among the config, tool
+// and request values.
+func EffectiveTimeoutMs(values ...int) int {
+	eff := 0
+	for _, v := range values {
+		if v > 0 && (eff == 0 || v < eff) {
+			eff = v
+		}
+	}
+	return eff
+}
+
+// Run executes one tool invocation. Cancelling ctx (for example when the HTTP
+// client disconnects) kills the tool process.
+//
+// A tool with a retry policy is rerun while attempts fail retryably; the
+// result is the final attempt's, with every attempt listed in Attempts.
+// Declared outputs and, with track_changes, the cwd tree are snapshotted
+// around all attempts into Artifacts and Changes. A "scratch" workspace runs
+// the tool in a throwaway copy of cwd instead. Tools with cwd_policy "none"
+// (or "optional" and no cwd) run in an empty directory removed afterwards.
+func Run(ctx context.Context, spec registry.ToolSpec, req RunRequest, opts Options) RunResult {
+	switch {
+	case spec.CwdPolicy == "none" || (spec.CwdPolicy == "optional" && req.Cwd == ""):
+		if req.Workspace != "" {
+			return codeErr("ERR_INVALID_INPUT", "workspace requires a cwd", 40)
+		}
+		dir, err := bridgeTempDir(opts.ScratchDir, "nocwd-")
+		if err != nil {
+			return codeErr("ERR_EXEC_FAILED", "empty working directory: "+err.Error(), 70)
+		}
+		defer os.RemoveAll(dir)
+		req.Cwd, opts.Roots = dir, []config.Root{{Path: dir}}
+	case strings.TrimSpace(req.Cwd) == "":
+		return codeErr("ERR_INVALID_INPUT", "cwd is required for this tool", 40)
+	case !filepath.IsAbs(req.Cwd):
+		return codeErr("ERR_INVALID_INPUT", "cwd must be an absolute path", 40)
+	}
+	switch req.Workspace {
+	case "":
+	case "scratch":
+		return runScratch(ctx, spec, req, opts)
+	default:
+		return codeErr("ERR_INVALID_INPUT", "workspace must be \"scratch\" or omitted", 40)
+	}
+	return runTracked(ctx, spec, req, opts)
+}
+
+// bridgeTempDir creates a fresh directory under scratchDir, or under the
+// system temp dir when scratchDir is not set.
+func bridgeTempDir(scratchDir, prefix string) (string, error) {
+	if scratchDir != "" {
+		if err := os.MkdirAll(scratchDir, 0o700); err != nil {
+			return "", err
+		}
+	}
+	return os.MkdirTemp(scratchDir, prefix)
+}
+
+// runScratch runs the tool in a copy of cwd under opts.ScratchDir and
+// reports what it changed there relative to the untouched original.
+func runScratch(ctx context.Context, spec registry.ToolSpec, req RunRequest, opts Options) RunResult {
+	// Reject what can be rejected against the original before paying for
+	// the copy; run repeats the checks inside it.
+	plan, bad := checkRun(spec, req, opts)
+	if bad != nil {
+		return *bad
+	}
+	root := plan.root
+	dir, err := bridgeTempDir(opts.ScratchDir, "run-")
+	if err != nil {
+		return codeErr("ERR_EXEC_FAILED", "scratch workspace: "+err.Error(), 70)
+	}
+	realDir, _ := filepath.EvalSymlinks(dir)
+	if realCwd, err := filepath.EvalSymlinks(req.Cwd); err == nil && within(realDir, realCwd) {
+		os.RemoveAll(dir)
+		return codeErr("ERR_INVALID_INPUT", "scratch_dir is inside cwd; a scratch copy would contain itself", 40)
+	}
+	if !req.KeepScratch {
+		defer workspace.Remove(dir)
+	}
+	lim := treeLimits(spec.TrackChanges)
+	if err := workspace.Copy(req.Cwd, dir, lim); err != nil {
+		return codeErr("ERR_EXEC_FAILED", "scratch workspace: "+err.Error(), 70)
+	}
+	orig := req.Cwd
+	// The copy keeps the root's policy, but only the copy is writable: the
+	// run is confined to it and the original root is read-only.
+	req.Cwd = dir
+	opts.Roots = []config.Root{{Path: dir, Tools: root.Tools, MaxRuntimeMs: root.MaxRuntimeMs, EnvAllowlist: root.EnvAllowlist, DenySubpaths: scratchDenySubpaths(root, orig)}}
+	opts.Confine = dir
+	opts.ReadOnly = append(opts.ReadOnly, root.Path)
+	res := runTracked(ctx, spec, req, opts)
+	before, cut := artifacts.SnapshotTree(orig, lim)
+	after, cutAfter := artifacts.SnapshotTree(dir, lim)
+	res.Changes = artifacts.Changes(before, after)
+	if cut || cutAfter {
+		res.Warnings = append(res.Warnings, changesTruncated(lim))
+	}
+	res.Patch = workspace.Patch(orig, dir, res.Changes, DefaultMaxFileBytes)
+	if vals, err := secrets.Resolve(opts.SecretsDir, spec.Secrets); err == nil && len(vals) > 0 {
+		res.Patch = secrets.Scrub(res.Patch, vals)
+	}
+	if req.KeepScratch {
+		res.ScratchDir = dir
+	}
+	return res
+}
+
+// scratchDenySubpaths maps root's deny_subpaths beneath cwd to paths
+// relative to cwd, so they stay denied in its scratch copy.
+func scratchDenySubpaths(root config.Root, cwd string) []string {
+	realCwd, err := filepath.EvalSymlinks(cwd)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, d := range root.DenySubpaths {
+		if !filepath.IsAbs(d) {
+			d = filepath.Join(root.Path, d)
+		}
+		if rd, err := filepath.EvalSymlinks(d); err == nil {
+			d = rd
+		}
+		if rel, err := filepath.Rel(realCwd, d); err == nil && filepath.IsLocal(rel) {
+			out = append(out, rel)
+		}
+	}
+	return out
+}
+
+func runTracked(ctx context.Context, spec registry.ToolSpec, req RunRequest, opts Options) RunResult {
+	if _, ok := IsWithinRoots(req.Cwd, opts.Roots); !ok || (len(spec.Outputs) == 0 && spec.TrackChanges == nil) {
+		return runAttempts(ctx, spec, req, opts)
+	}
+	var outputs, tree map[string]artifacts.File
+	var cut bool
+	lim := treeLimits(spec.TrackChanges)
+	if len(spec.Outputs) > 0 {
+		outputs = artifacts.Snapshot(req.Cwd, spec.Outputs)
+	}
+	if spec.TrackChanges != nil {
+		tree, cut = artifacts.SnapshotTree(req.Cwd, lim)
+	}
+	res := runAttempts(ctx, spec, req, opts)
+	if outputs != nil {
+		res.Artifacts = artifacts.Diff(outputs, artifacts.Snapshot(req.Cwd, spec.Outputs))
+	}
+	if tree != nil {
+		after, cutAfter := artifacts.SnapshotTree(req.Cwd, lim)
+		res.Changes = artifacts.Changes(tree, after)
+		if cut || cutAfter {
+			res.Warnings = append(res.Warnings, changesTruncated(lim))
+		}
+		applyWriteScope(spec, &res)
+	}
+	return res
+}
+
+// Default change tracking limits, used when the tool does not set
+// max_file_bytes, max_total_bytes or max_files.
+const (
+	DefaultMaxFileBytes  = 8 << 20
+	DefaultMaxTotalBytes = 256 << 20
+	DefaultMaxFiles      = 100000
+)
+
+// treeLimits returns the snapshot limits of c, which may be nil.
+func treeLimits(c *registry.ChangeSpec) artifacts.TreeLimits {
+	lim := artifacts.TreeLimits{MaxFileBytes: DefaultMaxFileBytes, MaxTotalBytes: DefaultMaxTotalBytes, MaxFiles: DefaultMaxFiles}
+	if c == nil {
+		return lim
+	}
+	if c.MaxFileBytes > 0 {
+		lim.MaxFileBytes = c.MaxFileBytes
+	}
+	if c.MaxTotalBytes > 0 {
+		lim.MaxTotalBytes = c.MaxTotalBytes
+	}
+	if c.MaxFiles > 0 {
+		lim.MaxFiles = c.MaxFiles
+	}
+	return lim
+}
+
+func changesTruncated(lim artifacts.TreeLimits) ErrPayload {
+	return ErrPayload{Code: "WARN_CHANGES_TRUNCATED", Message: fmt.Sprintf("the cwd tree exceeds %d files or %d hashed bytes; changes may be incomplete", lim.MaxFiles, lim.MaxTotalBytes)}
+}
+
+// applyWriteScope flags changes outside the tool's write scope as warnings
+// or, under on_violation "fail", as a failed run.
+func applyWriteScope(spec registry.ToolSpec, res *RunResult) {
+	tc := spec.TrackChanges
+	if len(tc.WriteScope) == 0 {
+		return
+	}
+	scope := append(append([]string{}, tc.WriteScope...), spec.Outputs...)
+	var outside []string
+	for _, c := range res.Changes {
+		if !InWriteScope(c.Path, scope) {
+			outside = append(outside, c.Path)
+		}
+	}
+	if len(outside) == 0 {
+		return
+	}
+	msg := "changed files outside write_scope: " + strings.Join(outside, ", ")
+	if tc.OnViolation == "fail" {
+		res.OK, res.ExitCode, res.HTTPStatus = false, 40, 0
+		res.Error = &ErrPayload{Code: "ERR_WRITE_SCOPE_VIOLATION", Message: msg}
+		return
+	}
+	res.Warnings = append(res.Warnings, ErrPayload{Code: "WARN_WRITE_SCOPE", Message: msg})
+}
+
+// InWriteScope reports whether the slash-separated path p matches one of the
+// scope globs or lies beneath one of the scope directories.
+func InWriteScope(p string, scope []string) bool {
+	for _, s := range scope {
+		s = strings.TrimSuffix(filepath.ToSlash(s), "/")
+		if ok, _ := path.Match(s, p); ok || strings.HasPrefix(p, s+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// policyRoots returns the roots holding cwd and the tool's working_dir. Both
+// policies apply to a run, so the stricter value of each wins.
+func policyRoots(spec registry.ToolSpec, cwd string, roots []config.Root) []config.Root {
+	var out []config.Root
+	if r, ok := IsWithinRoots(cwd, roots); ok {
+		out = append(out, r)
+	}
+	if dir, err := ResolveWorkingDir(spec, cwd); err == nil {
+		if r, ok := IsWithinRoots(dir, roots); ok {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// rootEnvAllowlist is the env allowlist for a run in roots: a root's
+// env_allowlist replaces the daemon list, and several intersect.
+func rootEnvAllowlist(daemon []string, roots ...config.Root) []string {
+	out, set := daemon, false
+	for _, r := range roots {
+		if len(r.EnvAllowlist) == 0 {
+			continue
+		}
+		if !set {
+			out, set = r.EnvAllowlist, true
+			continue
+		}
+		out = slices.DeleteFunc(slices.Clone(out), func(k string) bool { return !slices.Contains(r.EnvAllowlist, k) })
+	}
+	return out
+}
+
+func runAttempts(ctx context.Context, spec registry.ToolSpec, req RunRequest, opts Options) RunResult {
+	timeoutMs := EffectiveTimeoutMs(opts.TimeoutMs, spec.TimeoutMs, req.TimeoutMs)
+	for _, r := range policyRoots(spec, req.Cwd, opts.Roots) {
+		timeoutMs = EffectiveTimeoutMs(timeoutMs, r.MaxRuntimeMs)
+	}
+	res := run(ctx, spec, req, opts, timeoutMs)
+	res.TimeoutMs = timeoutMs
+	if spec.Retry == nil {
+		return res
+	}
+	attempts := []RunResult{res}
+	for n := 1; n < spec.Retry.MaxAttempts && Retryable(spec.Retry, res); n++ {
+		t := time.NewTimer(RetryBackoff(spec.Retry, n))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			res.Attempts = attempts
+			return res
+		case <-t.C:
+		}
+		res = run(ctx, spec, req, opts, timeoutMs)
+		res.TimeoutMs = timeoutMs
+		attempts = append(attempts, res)
+	}
+	res.Attempts = attempts
+	return res
+}
+
+// Retryable reports whether a failed attempt may be retried under policy.
+// Canceled runs never are.
+func Retryable(policy *registry.RetrySpec, res RunResult) bool {
+	if res.OK || res.Error == nil || res.Error.Code == "ERR_CANCELED" {
+		return false
+	}
+	return slices.Contains(policy.ExitCodes, res.ExitCode) || slices.Contains(policy.ErrorCodes, res.Error.Code)
+}
+
+// RetryBackoff is the delay before retry n (1-based): BackoffMs doubled for
+// every earlier retry.
+func RetryBackoff(policy *registry.RetrySpec, n int) time.Duration {
+	d := time.Duration(policy.BackoffMs) * time.Millisecond
+	for i := 1; i < n && i < 16; i++ {
+		d *= 2
+	}
+	return d
+}
+
+// runPlan is what checkRun resolved for a run before anything executes.
+type runPlan struct {
+	root, dirRoot config.Root
+	dir           string
+	stdin         []byte
+}
+
+// checkRun applies the checks that need no process or copy: allowlisted
+// cwd and working_dir, the roots' tools, mode, stdin and arg constraints.
+func checkRun(spec registry.ToolSpec, req RunRequest, opts Options) (runPlan, *RunResult) {
+	fail := func(code, msg string, exit int) (runPlan, *RunResult) {
+		res := codeErr(code, msg, exit)
+		return runPlan{}, &res
+	}
+	var p runPlan
+	var ok bool
+	if p.root, ok = IsWithinRoots(req.Cwd, opts.Roots); !ok {
+		return fail("ERR_CWD_NOT_ALLOWLISTED", "cwd is not in allowlisted roots", 40)
+	}
+	if req.Mode == "jsonl" && spec.OutputFormat != "jsonl" {
+		return fail("ERR_INVALID_INPUT", "tool does not declare output_format jsonl", 40)
+	}
+	dir, err := ResolveWorkingDir(spec, req.Cwd)
+	if err != nil {
+		return fail("ERR_INVALID_INPUT", err.Error(), 40)
+	}
+	p.dir = dir
+	if p.dirRoot, ok = IsWithinRoots(dir, opts.Roots); !ok {
+		return fail("ERR_CWD_NOT_ALLOWLISTED", "working_dir is not in allowlisted roots", 40)
+	}
+	for _, r := range []config.Root{p.root, p.dirRoot} {
+		if len(r.Tools) > 0 && !slices.Contains(r.Tools, spec.Name) {
+			return fail("ERR_TOOL_NOT_ALLOWED", "tool is not allowed in this root", 40)
+		}
+	}
+	if p.stdin, err = StdinBytes(spec, req, opts.MaxStdinBytes); err != nil {
+		return fail("ERR_INVALID_INPUT", err.Error(), 40)
+	}
+	if bad := ValidateArgs(spec, req.Args); bad != nil {
+		return runPlan{}, bad
+	}
+	return p, nil
+}
+
+func run(ctx context.Context, spec registry.ToolSpec, req RunRequest, opts Options, timeoutMs int) RunResult {
+	roots := opts.Roots
+	plan, bad := checkRun(spec, req, opts)
+	if bad != nil {
+		return *bad
+	}
+	root, dirRoot, dir, stdin := plan.root, plan.dirRoot, plan.dir, plan.stdin
+	envAllow := rootEnvAllowlist(opts.EnvAllow, root, dirRoot)
+	readOnly := slices.Clone(opts.ReadOnly)
+	for _, r := range []config.Root{root, dirRoot} {
+		if r.ReadOnly {
+			readOnly = append(readOnly, r.Path)
+		}
+	}
+	args, argRoots, bad := ResolvePathArgs(spec, req.Args, req.Cwd, roots)
+	if bad != nil {
+		return *bad
+	}
+	req.Args = args
+	for _, r := range argRoots {
+		if !slices.Contains(readOnly, r) {
+			readOnly = append(readOnly, r)
+		}
 	}
 	argv := BuildArgv(spec, req)
 	if len(argv) == 0 {
 		return codeErr("ERR_EXEC_FAILED", "empty argv", 70)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
-	cmd.Dir = req.Cwd
-	env := []string{}
-	allow := map[string]bool{}
-	for _, k := range envAllow {
-		allow[k] = true
-		if v, ok := os.LookupEnv(k); ok {
-			env = append(env, k+"="+v)
+	secretVals, err := secrets.Resolve(opts.SecretsDir, spec.Secrets)
+	if err != nil {
+		return codeErr("ERR_SECRET_UNAVAILABLE", err.Error(), 70)
+	}
+	env, envRes := ResolveEnv(spec, req.Env, envAllow, secretVals)
+	onEvent := opts.OnEvent
+	if onEvent != nil && len(secretVals) > 0 {
+		onEvent = func(line int, event any) { opts.OnEvent(line, secrets.ScrubJSON(event, secretVals)) }
+	}
+	res := execute(ctx, spec, req, invocation{argv: argv, dir: dir, env: env, stdin: stdin, onEvent: onEvent, readOnly: readOnly, confine: opts.Confine}, timeoutMs)
+	res.Env = &envRes
+	if len(secretVals) > 0 {
+		res.Stdout = secrets.Scrub(res.Stdout, secretVals)
+		res.Stderr = secrets.Scrub(res.Stderr, secretVals)
+		if res.StdoutJS != nil {
+			res.StdoutJS = secrets.ScrubJSON(res.StdoutJS, secretVals)
 		}
 	}
-	for k, v := range req.Env {
-		if allow[k] {
-			env = append(env, k+"="+v)
+	return res
+}
+
+// invocation is a fully resolved process launch.
+type invocation struct {
+	argv    []string
+	dir     string
+	env     []string
+	stdin   []byte
+	onEvent func(line int, event any)
+	// readOnly lists read_only roots the process must not write to.
+	readOnly []string
+	// confine, if set, is the only tree (besides the temp dir) the process
+	// may write to.
+	confine string
+}
+
+func execute(ctx context.Context, spec registry.ToolSpec, req RunRequest, inv invocation, timeoutMs int) RunResult {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, inv.argv[0], inv.argv[1:]...)
+	cmd.Dir = inv.dir
+	cmd.Env = inv.env
+	if spec.Sandbox != nil || len(inv.readOnly) > 0 || inv.confine != "" {
+		if err := sandbox.Wrap(cmd, sandboxProfile(spec.Sandbox, cmd.Dir, inv.readOnly, inv.confine)); err != nil {
+			return codeErr("ERR_SANDBOX_UNAVAILABLE", err.Error(), 70)
 		}
 	}
-	cmd.Env = env
+	if inv.stdin != nil {
+		cmd.Stdin = bytes.NewReader(inv.stdin)
+	}
 	var outb, errb bytes.Buffer
-	cmd.Stdout = &outb
-	cmd.Stderr = &errb
-	err := cmd.Run()
+	var stdout io.Writer = &outb
+	var events *eventWriter
+	switch {
+	case inv.onEvent == nil:
+	case spec.TTY:
+		events = &eventWriter{buf: &outb, fn: inv.onEvent, parse: func(b []byte) (any, bool) {
+			return map[string]any{"text": ttyText(strings.TrimSuffix(string(b), "\r"), spec.StripANSI)}, true
+		}}
+	case req.Mode == "jsonl":
+		events = &eventWriter{buf: &outb, fn: inv.onEvent, parse: jsonlEvent}
+	}
+	if events != nil {
+		stdout = events
+	}
+	start := time.Now()
+	var err error
+	if spec.TTY {
+		rows, cols := ttySize(spec.TTYSize)
+		master, terr := startTTY(cmd, rows, cols)
+		if errors.Is(terr, pty.ErrUnavailable) {
+			return codeErr("ERR_TTY_UNAVAILABLE", terr.Error(), 70)
+		}
+		if terr != nil {
+			return codeErr("ERR_EXEC_FAILED", "tool execution failed", 70)
+		}
+		err = waitTTY(cmd, master, stdout)
+	} else {
+		cmd.Stdout, cmd.Stderr = stdout, &errb
+		err = cmd.Run()
+	}
+	if events != nil {
+		events.flush()
+	}
+	usage := processUsage(cmd.ProcessState, time.Since(start), outb.Len(), errb.Len())
 	out := outb.String()
+	if spec.TTY {
+		out = ttyText(out, spec.StripANSI)
+	}
 	errOut := errb.String()
 	if ctx.Err() == context.DeadlineExceeded {
-		return codeErr("ERR_TIMEOUT", "command timed out", 124)
+		res := codeErr("ERR_TIMEOUT", "command timed out", 124)
+		res.Usage = usage
+		return res
+	}
+	if ctx.Err() == context.Canceled {
+		res := codeErr("ERR_CANCELED", "run canceled by client", 130)
+		res.Usage = usage
+		return res
 	}
+	exitCode, mapped := 0, registry.ExitCodeSpec{OK: true}
 	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			return RunResult{OK: false, ExitCode: ee.ExitCode(), Error: &ErrPayload{Code: "ERR_EXEC_FAILED", Message: "command failed"}, Stdout: out, Stderr: errOut}
+		ee, ok := err.(*exec.ExitError)
+		if !ok {
+			return codeErr("ERR_EXEC_FAILED", "tool execution failed", 70)
 		}
-		return codeErr("ERR_EXEC_FAILED", "tool execution failed", 70)
+		exitCode, mapped = ee.ExitCode(), spec.ExitCodes[ee.ExitCode()]
+	}
+	res := RunResult{OK: true, ExitCode: exitCode, Stdout: out, Stderr: errOut, Usage: usage, HTTPStatus: mapped.HTTPStatus}
+	if !mapped.OK {
+		res.OK, res.Error = false, exitErr(mapped)
 	}
-	res := RunResult{OK: true, ExitCode: 0, Stdout: out, Stderr: errOut}
-	if spec.JsonMode && req.Mode == "json" {
+	// Failed runs often print a JSON error object, so parse whatever the tool
+	// printed; only a successful run requires it.
+	switch {
+	case req.Mode == "jsonl":
+		events, jerr := ParseJSONLines(out)
+		var le *LineError
+		switch {
+		case jerr == nil:
+			res.StdoutJS = events
+		case res.OK && errors.As(jerr, &le):
+			res.OK, res.ExitCode, res.HTTPStatus = false, 40, 0
+			res.Error = &ErrPayload{Code: "ERR_STDOUT_NOT_JSON", Message: le.Error(), Line: le.Line}
+		}
+	case spec.JsonMode && req.Mode == "json":
 		obj, jerr := ParseOneJSONObject(out)
-		if jerr != nil {
-			return codeErr("ERR_STDOUT_NOT_JSON", "stdout is not exactly one JSON object", 40)
+		switch {
+		case jerr == nil:
+			res.StdoutJS = obj
+		case res.OK:
+			res.OK, res.ExitCode, res.HTTPStatus = false, 40, 0
+			res.Error = &ErrPayload{Code: "ERR_STDOUT_NOT_JSON", Message: "stdout is not exactly one JSON object"}
 		}
-		res.StdoutJS = obj
 	}
 	return res
 }
+
+// exitErr is the error for a failed exit, as described by the tool's
+// exit_codes entry or the generic ERR_EXEC_FAILED.
+func exitErr(ec registry.ExitCodeSpec) *ErrPayload {
+	e := &ErrPayload{Code: "ERR_EXEC_FAILED", Message: "command failed"}
+	if ec.Code != "" {
+		e.Code = ec.Code
+	}
+	if ec.Message != "" {
+		e.Message = ec.Message
+	}
+	return e
+}
+
+// sandboxProfile builds the confinement for a run. Tools without a sandbox
+// spec only get one when a read_only root is involved or the run is confined;
+// then the temp dir is writable too, and nothing inside or above a readOnly
+// root is. A confined run drops write paths outside confine.
+func sandboxProfile(s *registry.SandboxSpec, dir string, readOnly []string, confine string) sandbox.Profile {
+	if s == nil {
+		s = &registry.SandboxSpec{AllowNetwork: true}
+	}
+	p := sandbox.Profile{AllowNetwork: s.AllowNetwork}
+	writable := []string{dir}
+	if len(readOnly) > 0 || confine != "" {
+		writable = append(writable, os.TempDir())
+	}
+	for _, w := range s.WritePaths {
+		if !filepath.IsAbs(w) {
+			w = filepath.Join(dir, w)
+		}
+		if confine == "" || within(filepath.Clean(w), confine) {
+			writable = append(writable, w)
+		}
+	}
+	for _, w := range writable {
+		w = filepath.Clean(w)
+		// Landlock grants whole trees, so a path above a read-only root is
+		// dropped as well as one inside it.
+		if !slices.ContainsFunc(readOnly, func(r string) bool { return within(w, r) || within(r, w) }) {
+			p.WritePaths = append(p.WritePaths, w)
+		}
+	}
+	return p
+}
+
+func processUsage(ps *os.ProcessState, wall time.Duration, stdoutBytes, stderrBytes int) *Usage {
+	if ps == nil {
+		return nil
+	}
+	return &Usage{
+		WallMs:      wall.Milliseconds(),
+		UserCPUMs:   ps.UserTime().Milliseconds(),
+		SystemCPUMs: ps.SystemTime().Milliseconds(),
+		MaxRSSKB:    maxRSSKB(ps),
+		StdoutBytes: int64(stdoutBytes),
+		StderrBytes: int64(stderrBytes),
+	}
+}
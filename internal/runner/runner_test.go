@@ -1,13 +1,175 @@
 package runner
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"musketeer-bridge/internal/config"
+	"musketeer-bridge/internal/registry"
+)
 
 func TestAllowlist(t *testing.T) {
-	if IsWithinRoots("/tmp", []string{"/Users/none"}) {
+	if _, ok := IsWithinRoots("/tmp", []config.Root{{Path: "/Users/none"}}); ok {
 		t.Fatal("unexpected allow")
 	}
 }
 
+func TestRootPolicy(t *testing.T) {
+	base := t.TempDir()
+	for _, d := range []string{"repo/scratch", "repo/secrets/keys", "repo/src"} {
+		if err := os.MkdirAll(filepath.Join(base, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	roots := []config.Root{
+		{Path: filepath.Join(base, "repo"), ReadOnly: true, DenySubpaths: []string{"secrets"}},
+		{Path: filepath.Join(base, "repo", "scratch")},
+	}
+	if r, ok := IsWithinRoots(filepath.Join(base, "repo", "src"), roots); !ok || !r.ReadOnly {
+		t.Fatalf("expected the read-only repo root, got %+v, %v", r, ok)
+	}
+	if r, ok := IsWithinRoots(filepath.Join(base, "repo", "scratch"), roots); !ok || r.ReadOnly {
+		t.Fatalf("expected the more specific scratch root, got %+v, %v", r, ok)
+	}
+	if _, ok := IsWithinRoots(filepath.Join(base, "repo", "secrets", "keys"), roots); ok {
+		t.Fatal("expected deny_subpaths to reject cwd")
+	}
+	if got := scratchDenySubpaths(roots[0], filepath.Join(base, "repo")); len(got) != 1 || got[0] != "secrets" {
+		t.Fatalf("expected deny_subpaths to carry over to a scratch copy, got %v", got)
+	}
+	if got := scratchDenySubpaths(roots[0], filepath.Join(base, "repo", "src")); len(got) != 0 {
+		t.Fatalf("expected no deny_subpaths beneath src, got %v", got)
+	}
+}
+
+func TestResolvePathArgs(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	if err := os.Mkdir(filepath.Join(root, "secrets"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	roots := []config.Root{{Path: root, DenySubpaths: []string{"secrets"}}}
+	spec := registry.ToolSpec{Exec: registry.ExecSpec{ArgsMap: []registry.ArgMap{{Input: "out", Flag: "--out", Kind: "path"}}}}
+	args, _, bad := ResolvePathArgs(spec, map[string]interface{}{"out": "a/b/c.txt", "n": 1.0}, root, roots)
+	if bad != nil || args["out"] != filepath.Join(root, "a", "b", "c.txt") || args["n"] != 1.0 {
+		t.Fatalf("expected a resolved not-yet-existing path, got %v, %+v", args, bad)
+	}
+	if _, _, bad := ResolvePathArgs(spec, map[string]interface{}{"out": "secrets/key"}, root, roots); bad == nil || bad.Error.Code != "ERR_PATH_NOT_ALLOWLISTED" {
+		t.Fatalf("expected deny_subpaths to reject the path, got %+v", bad)
+	}
+
+	outside := t.TempDir()
+	for link, target := range map[string]string{
+		"pwned":  filepath.Join(outside, "pwned.txt"),
+		"hop":    "pwned",
+		"up":     "../" + filepath.Base(outside) + "/x",
+		"inside": "new/file.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range []string{"pwned", "hop", "up", "hop/x"} {
+		if _, _, bad := ResolvePathArgs(spec, map[string]interface{}{"out": link}, root, roots); bad == nil || bad.Error.Code != "ERR_PATH_NOT_ALLOWLISTED" {
+			t.Fatalf("expected dangling link %q out of the root to be rejected, got %+v", link, bad)
+		}
+	}
+	args, _, bad = ResolvePathArgs(spec, map[string]interface{}{"out": "inside"}, root, roots)
+	if bad != nil || args["out"] != filepath.Join(root, "new", "file.txt") {
+		t.Fatalf("expected a dangling link inside the root to resolve to its target, got %v, %+v", args, bad)
+	}
+
+	ro, _ := filepath.EvalSymlinks(t.TempDir())
+	other, _ := filepath.EvalSymlinks(t.TempDir())
+	spec.Name = "fake"
+	roots = append(roots, config.Root{Path: ro, ReadOnly: true}, config.Root{Path: other, Tools: []string{"else"}})
+	_, readOnly, bad := ResolvePathArgs(spec, map[string]interface{}{"out": filepath.Join(ro, "f")}, root, roots)
+	if bad != nil || len(readOnly) != 1 || readOnly[0] != ro {
+		t.Fatalf("expected the read_only root to be reported, got %v, %+v", readOnly, bad)
+	}
+	if _, _, bad := ResolvePathArgs(spec, map[string]interface{}{"out": filepath.Join(other, "f")}, root, roots); bad == nil || bad.Error.Code != "ERR_PATH_NOT_ALLOWLISTED" {
+		t.Fatalf("expected a root that excludes the tool to be rejected, got %+v", bad)
+	}
+}
+
+func TestSandboxProfileReadOnly(t *testing.T) {
+	p := sandboxProfile(nil, "/work/repo", []string{"/data/ro"}, "")
+	if !slices.Contains(p.WritePaths, "/work/repo") || !p.AllowNetwork {
+		t.Fatalf("expected cwd to stay writable beside an unrelated read-only root, got %+v", p)
+	}
+	p = sandboxProfile(nil, "/data/ro/sub", []string{"/data/ro"}, "")
+	if slices.Contains(p.WritePaths, "/data/ro/sub") {
+		t.Fatalf("expected nothing inside the read-only root to be writable, got %+v", p)
+	}
+	p = sandboxProfile(&registry.SandboxSpec{WritePaths: []string{"cache", "/home/u/.cache"}}, "/scratch/run-1", nil, "/scratch/run-1")
+	if !slices.Contains(p.WritePaths, "/scratch/run-1/cache") || slices.Contains(p.WritePaths, "/home/u/.cache") {
+		t.Fatalf("expected a confined run to drop write paths outside the scratch dir, got %+v", p)
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	one := 1.0
+	m := registry.ArgMap{Input: "v", MaxLength: 3}
+	n := registry.ArgMap{Input: "n", Min: &one}
+	dash := registry.ArgMap{Input: "d", AllowLeadingDash: true}
+	cases := []struct {
+		m    registry.ArgMap
+		v    interface{}
+		rule string
+	}{
+		{m, "abc", ""},
+		{m, "abcd", "max_length"},
+		{m, "-x", "leading_dash"},
+		{m, "a\x00", "control"},
+		{m, []interface{}{"ok", "-rf"}, "leading_dash"},
+		{dash, "-1", ""},
+		{dash, "\r", "control"},
+		{n, 0.5, "min"},
+		{n, "2", "type"},
+		{n, 2.0, ""},
+		{n, json.Number("-5"), "min"},
+		{n, json.Number("3"), ""},
+		{n, true, "type"},
+		{m, json.Number("-5"), "leading_dash"},
+		{m, map[string]interface{}{"a": 1.0}, "type"},
+		{m, 42.0, ""},
+		{dash, json.Number("-5"), ""},
+		{registry.ArgMap{Input: "plain"}, -3.0, "leading_dash"},
+		{registry.ArgMap{Input: "plain"}, true, ""},
+		{registry.ArgMap{Input: "plain"}, map[string]interface{}{"a": "b\nc\x00"}, "type"},
+		{registry.ArgMap{Input: "plain"}, []interface{}{[]interface{}{"x\ny"}}, "type"},
+		{registry.ArgMap{Input: "plain"}, []interface{}{"x", true}, ""},
+	}
+	for _, c := range cases {
+		spec := registry.ToolSpec{Exec: registry.ExecSpec{ArgsMap: []registry.ArgMap{c.m}}}
+		bad := ValidateArgs(spec, map[string]interface{}{c.m.Input: c.v})
+		got := ""
+		if bad != nil {
+			got = bad.Error.Fields[0].Rule
+		}
+		if got != c.rule {
+			t.Fatalf("%v: expected rule %q, got %q", c.v, c.rule, got)
+		}
+	}
+}
+
+func TestRootEnvAllowlist(t *testing.T) {
+	daemon := []string{"PATH", "HOME", "USER"}
+	if got := rootEnvAllowlist(daemon, config.Root{}, config.Root{}); !slices.Equal(got, daemon) {
+		t.Fatalf("expected the daemon list, got %v", got)
+	}
+	if got := rootEnvAllowlist(daemon, config.Root{}, config.Root{EnvAllowlist: []string{"LANG"}}); !slices.Equal(got, []string{"LANG"}) {
+		t.Fatalf("expected the root list to replace the daemon list, got %v", got)
+	}
+	got := rootEnvAllowlist(daemon, config.Root{EnvAllowlist: []string{"PATH", "LANG"}}, config.Root{EnvAllowlist: []string{"LANG", "HOME"}})
+	if !slices.Equal(got, []string{"LANG"}) {
+		t.Fatalf("expected the root lists to intersect, got %v", got)
+	}
+}
+
 func TestJSONParse(t *testing.T) {
 	if _, err := ParseOneJSONObject("{\"a\":1}"); err != nil {
 		t.Fatal(err)
@@ -16,3 +178,186 @@ func TestJSONParse(t *testing.T) {
 		t.Fatal("expected error")
 	}
 }
+
+func TestResolveWorkingDir(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"":                root + "/a/b",
+		"{cwd}/c":         root + "/a/b/c",
+		"..":              root + "/a",
+		"{git_root}":      root,
+		"{git_root}/docs": root + "/docs",
+	}
+	for wd, want := range cases {
+		spec := registry.ToolSpec{Exec: registry.ExecSpec{WorkingDir: wd}}
+		got, err := ResolveWorkingDir(spec, sub)
+		if err != nil {
+			t.Fatalf("%q: %v", wd, err)
+		}
+		if got != filepath.Clean(want) {
+			t.Fatalf("%q: expected %q, got %q", wd, want, got)
+		}
+	}
+	if _, err := ResolveWorkingDir(registry.ToolSpec{Exec: registry.ExecSpec{WorkingDir: "{git_root}"}}, t.TempDir()); err == nil {
+		t.Fatal("expected error without a git repository")
+	}
+	if _, err := ResolveWorkingDir(registry.ToolSpec{Exec: registry.ExecSpec{WorkingDir: "{home}"}}, sub); err == nil {
+		t.Fatal("expected error for unknown placeholder")
+	}
+}
+
+func TestEffectiveTimeoutMs(t *testing.T) {
+	if got := EffectiveTimeoutMs(600000, 0, 0); got != 600000 {
+		t.Fatalf("expected config timeout, got %d", got)
+	}
+	if got := EffectiveTimeoutMs(600000, 30000, 0); got != 30000 {
+		t.Fatalf("expected tool timeout, got %d", got)
+	}
+	if got := EffectiveTimeoutMs(600000, 30000, 5000); got != 5000 {
+		t.Fatalf("expected request timeout, got %d", got)
+	}
+	if got := EffectiveTimeoutMs(1000, 30000, 5000); got != 1000 {
+		t.Fatalf("request must not extend config timeout, got %d", got)
+	}
+}
+
+func TestStdinBytes(t *testing.T) {
+	raw := registry.ToolSpec{Stdin: "raw"}
+	if b, err := StdinBytes(raw, RunRequest{Stdin: "abc"}, 3); err != nil || string(b) != "abc" {
+		t.Fatalf("unexpected raw stdin: %q %v", b, err)
+	}
+	if _, err := StdinBytes(raw, RunRequest{Stdin: "abcd"}, 3); err == nil {
+		t.Fatal("expected size cap error")
+	}
+	if _, err := StdinBytes(raw, RunRequest{Stdin: map[string]any{"a": 1}}, 0); err == nil {
+		t.Fatal("expected error for object stdin in raw mode")
+	}
+	js := registry.ToolSpec{Stdin: "json"}
+	if b, err := StdinBytes(js, RunRequest{Stdin: map[string]any{"a": 1}}, 0); err != nil || string(b) != `{"a":1}` {
+		t.Fatalf("unexpected json stdin: %q %v", b, err)
+	}
+	if _, err := StdinBytes(js, RunRequest{Stdin: "{not json"}, 0); err == nil {
+		t.Fatal("expected error for invalid JSON string")
+	}
+	if b, err := StdinBytes(registry.ToolSpec{}, RunRequest{}, 0); err != nil || b != nil {
+		t.Fatalf("expected no stdin, got %q %v", b, err)
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	t.Setenv("BRIDGE_TEST_DAEMON", "daemon")
+	t.Setenv("BRIDGE_TEST_EXTRA", "extra")
+	spec := registry.ToolSpec{Env: &registry.EnvSpec{
+		Allow: []string{"BRIDGE_TEST_EXTRA"},
+		Set:   map[string]string{"LOOPEXEC_MODE": "json"},
+		Deny:  []string{"BRIDGE_TEST_DAEMON"},
+	}}
+	env, res := ResolveEnv(spec, map[string]string{"BRIDGE_TEST_DAEMON": "req", "OTHER": "x"}, []string{"BRIDGE_TEST_DAEMON"}, nil)
+	want := []string{"BRIDGE_TEST_EXTRA=extra", "LOOPEXEC_MODE=json"}
+	if len(env) != len(want) || env[0] != want[0] || env[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, env)
+	}
+	if len(res.Dropped) != 2 {
+		t.Fatalf("expected denied and unlisted request keys dropped, got %v", res.Dropped)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := &registry.RetrySpec{MaxAttempts: 3, BackoffMs: 100, ExitCodes: []int{75}, ErrorCodes: []string{"ERR_TIMEOUT"}}
+	cases := []struct {
+		res  RunResult
+		want bool
+	}{
+		{RunResult{OK: true}, false},
+		{RunResult{ExitCode: 75, Error: &ErrPayload{Code: "ERR_EXEC_FAILED"}}, true},
+		{RunResult{ExitCode: 1, Error: &ErrPayload{Code: "ERR_EXEC_FAILED"}}, false},
+		{RunResult{ExitCode: 124, Error: &ErrPayload{Code: "ERR_TIMEOUT"}}, true},
+		{RunResult{ExitCode: 130, Error: &ErrPayload{Code: "ERR_CANCELED"}}, false},
+	}
+	for _, c := range cases {
+		if got := Retryable(policy, c.res); got != c.want {
+			t.Fatalf("Retryable(%+v) = %v, want %v", c.res, got, c.want)
+		}
+	}
+	if d := RetryBackoff(policy, 1); d.Milliseconds() != 100 {
+		t.Fatalf("first backoff = %v", d)
+	}
+	if d := RetryBackoff(policy, 3); d.Milliseconds() != 400 {
+		t.Fatalf("third backoff = %v", d)
+	}
+}
+
+func TestParseJSONLines(t *testing.T) {
+	events, err := ParseJSONLines("{\"a\":1}\n\n{\"b\":2}\n")
+	if err != nil || len(events) != 2 {
+		t.Fatalf("expected two events, got %v, %v", events, err)
+	}
+	_, err = ParseJSONLines("{\"a\":1}\n[1]\n")
+	le, ok := err.(*LineError)
+	if !ok || le.Line != 2 {
+		t.Fatalf("expected error on line 2, got %v", err)
+	}
+}
+
+func TestInWriteScope(t *testing.T) {
+	scope := []string{".musketeer", "out/", "*.json"}
+	for p, want := range map[string]bool{
+		".musketeer/packets/p.json": true,
+		"out/a/b.txt":               true,
+		"report.json":               true,
+		"sub/report.json":           false,
+		"outside.txt":               false,
+		".musketeer-other/x":        false,
+	} {
+		if got := InWriteScope(p, scope); got != want {
+			t.Fatalf("InWriteScope(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestRunRejectsMissingCwd(t *testing.T) {
+	spec := registry.ToolSpec{Exec: registry.ExecSpec{Argv: []string{"true"}}}
+	for _, cwd := range []string{"", "  ", "relative/dir"} {
+		res := Run(context.Background(), spec, RunRequest{Cwd: cwd}, Options{Roots: []config.Root{{Path: "/"}}})
+		if res.Error == nil || res.Error.Code != "ERR_INVALID_INPUT" {
+			t.Fatalf("cwd %q: expected ERR_INVALID_INPUT, got %+v", cwd, res.Error)
+		}
+	}
+}
+
+func TestRunScratchRejectsScratchDirInCwd(t *testing.T) {
+	cwd := t.TempDir()
+	spec := registry.ToolSpec{Exec: registry.ExecSpec{Argv: []string{"true"}}}
+	opts := Options{Roots: []config.Root{{Path: cwd}}, ScratchDir: filepath.Join(cwd, ".musketeer", "scratch")}
+	res := Run(context.Background(), spec, RunRequest{Cwd: cwd, Workspace: "scratch"}, opts)
+	if res.Error == nil || res.Error.Code != "ERR_INVALID_INPUT" {
+		t.Fatalf("expected ERR_INVALID_INPUT, got %+v", res.Error)
+	}
+	if entries, _ := os.ReadDir(opts.ScratchDir); len(entries) != 0 {
+		t.Fatalf("expected no scratch copy to be left behind, got %v", entries)
+	}
+}
+
+func TestRunScratchChecksBeforeCopy(t *testing.T) {
+	cwd, scratch := t.TempDir(), filepath.Join(t.TempDir(), "scratch")
+	spec := registry.ToolSpec{Name: "fake", Exec: registry.ExecSpec{Argv: []string{"true"}, ArgsMap: []registry.ArgMap{{Input: "v", Flag: "--v"}}}}
+	for code, opts := range map[string]Options{
+		"ERR_TOOL_NOT_ALLOWED": {Roots: []config.Root{{Path: cwd, Tools: []string{"other"}}}, ScratchDir: scratch},
+		"ERR_INVALID_INPUT":    {Roots: []config.Root{{Path: cwd}}, ScratchDir: scratch},
+	} {
+		res := Run(context.Background(), spec, RunRequest{Cwd: cwd, Workspace: "scratch", Args: map[string]interface{}{"v": "-x"}}, opts)
+		if res.Error == nil || res.Error.Code != code {
+			t.Fatalf("expected %s, got %+v", code, res.Error)
+		}
+		if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected no scratch copy to be made, got %v", code, err)
+		}
+	}
+}
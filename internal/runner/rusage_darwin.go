@@ -0,0 +1,14 @@
+package runner
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSSKB reads ru_maxrss, which darwin reports in bytes.
+func maxRSSKB(ps *os.ProcessState) int64 {
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		return int64(ru.Maxrss) / 1024
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package runner
+
+import "os"
+
+func maxRSSKB(ps *os.ProcessState) int64 {
+	return 0
+}
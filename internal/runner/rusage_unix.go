@@ -0,0 +1,16 @@
+//go:build unix && !darwin
+
+package runner
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSSKB reads ru_maxrss, which Linux and the BSDs report in kilobytes.
+func maxRSSKB(ps *os.ProcessState) int64 {
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		return int64(ru.Maxrss)
+	}
+	return 0
+}
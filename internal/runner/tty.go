@@ -0,0 +1,51 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"musketeer-bridge/internal/registry"
+)
+
+// ttyDrain bounds how long output is still read after the tool exits, in
+// case a background process keeps the terminal open.
+const ttyDrain = 200 * time.Millisecond
+
+// ansiSeq matches CSI and OSC escape sequences and other two-byte escapes.
+var ansiSeq = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+func ttySize(s *registry.TTYSize) (rows, cols int) {
+	if s == nil {
+		return 24, 80
+	}
+	return s.Rows, s.Cols
+}
+
+// waitTTY copies terminal output from master to w until cmd has exited and
+// the terminal is drained.
+func waitTTY(cmd *exec.Cmd, master *os.File, w io.Writer) error {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(w, master)
+		close(done)
+	}()
+	err := cmd.Wait()
+	_ = master.SetReadDeadline(time.Now().Add(ttyDrain))
+	<-done
+	master.Close()
+	return err
+}
+
+// ttyText turns terminal output into plain text: CRLF line endings become LF
+// and, if strip is set, escape sequences are removed.
+func ttyText(s string, strip bool) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	if strip {
+		s = ansiSeq.ReplaceAllString(s, "")
+	}
+	return s
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package runner
+
+import (
+	"os"
+	"os/exec"
+
+	"musketeer-bridge/internal/pty"
+)
+
+func startTTY(cmd *exec.Cmd, rows, cols int) (*os.File, error) {
+	return nil, pty.ErrUnavailable
+}
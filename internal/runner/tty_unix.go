@@ -0,0 +1,33 @@
+//go:build unix
+
+package runner
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"musketeer-bridge/internal/pty"
+)
+
+// startTTY starts cmd in a new session whose controlling terminal is a fresh
+// pseudo-terminal, and returns the master side for reading its output.
+func startTTY(cmd *exec.Cmd, rows, cols int) (*os.File, error) {
+	master, slave, err := pty.Open(rows, cols)
+	if err != nil {
+		return nil, err
+	}
+	defer slave.Close()
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, err
+	}
+	return master, nil
+}
@@ -0,0 +1,17 @@
+// Package sandbox confines tool processes so they can only write beneath
+// declared paths and, unless allowed, cannot reach the network.
+package sandbox
+
+import "errors"
+
+// Profile is a sandbox profile with every path already resolved to an absolute path.
+type Profile struct {
+	WritePaths   []string `json:"write_paths"`
+	AllowNetwork bool     `json:"allow_network"`
+}
+
+// ErrUnavailable is returned by Wrap when the host cannot enforce a profile.
+var ErrUnavailable = errors.New("sandbox unavailable")
+
+// envKey carries the encoded profile from the bridge to the re-executed helper.
+const envKey = "MUSKETEER_BRIDGE_SANDBOX"
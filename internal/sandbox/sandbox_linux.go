@@ -0,0 +1,237 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	accessWriteFile  = 1 << 1
+	accessRemoveDir  = 1 << 4
+	accessRemoveFile = 1 << 5
+	accessMakeChar   = 1 << 6
+	accessMakeDir    = 1 << 7
+	accessMakeReg    = 1 << 8
+	accessMakeSock   = 1 << 9
+	accessMakeFifo   = 1 << 10
+	accessMakeBlock  = 1 << 11
+	accessMakeSym    = 1 << 12
+	accessRefer      = 1 << 13
+	accessTruncate   = 1 << 14
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+
+	probeValue = "probe"
+)
+
+// alwaysWritable are device files nearly every CLI writes to.
+var alwaysWritable = []string{"/dev/null"}
+
+type pathBeneathAttr struct {
+	AllowedAccess uint64
+	ParentFd      int32
+}
+
+var (
+	landlockOnce sync.Once
+	landlockErr  error
+	netnsOnce    sync.Once
+	netnsErr     error
+)
+
+// The helper runs before main: when the bridge re-executes itself with envKey
+// set, it confines the current thread and then execs the real tool in place.
+func init() {
+	v, ok := os.LookupEnv(envKey)
+	if !ok {
+		return
+	}
+	if v == probeValue {
+		os.Exit(0)
+	}
+	os.Exit(child(v))
+}
+
+func landlockABI() int {
+	v, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
+
+// Available reports whether Landlock and network namespaces can be used on this host.
+func Available() error {
+	if err := landlockAvailable(); err != nil {
+		return err
+	}
+	return netnsAvailable()
+}
+
+func landlockAvailable() error {
+	landlockOnce.Do(func() {
+		if landlockABI() < 1 {
+			landlockErr = fmt.Errorf("%w: landlock is not supported by this kernel", ErrUnavailable)
+		}
+	})
+	return landlockErr
+}
+
+// netnsAvailable probes for network namespaces by starting the helper in
+// one. Hosts without unprivileged user namespaces fail here but can still
+// run profiles that allow the network.
+func netnsAvailable() error {
+	netnsOnce.Do(func() {
+		self, err := os.Executable()
+		if err != nil {
+			netnsErr = fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+			return
+		}
+		cmd := exec.Command(self)
+		cmd.Env = []string{envKey + "=" + probeValue}
+		cmd.SysProcAttr = isolatedAttr()
+		if err := cmd.Run(); err != nil {
+			netnsErr = fmt.Errorf("%w: network namespace: %s", ErrUnavailable, err.Error())
+		}
+	})
+	return netnsErr
+}
+
+func isolatedAttr() *syscall.SysProcAttr {
+	if os.Geteuid() == 0 {
+		return &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	}
+	return &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}},
+	}
+}
+
+// Wrap rewrites cmd so that it starts the bridge binary as a helper, which
+// applies p and then execs the original command. cmd.Env must already be final.
+// Landlock is always required; network namespaces only when p denies the network.
+func Wrap(cmd *exec.Cmd, p Profile) error {
+	if err := landlockAvailable(); err != nil {
+		return err
+	}
+	if !p.AllowNetwork {
+		if err := netnsAvailable(); err != nil {
+			return err
+		}
+	}
+	if cmd.Err != nil {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{self, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	cmd.Env = append(cmd.Env, envKey+"="+string(b))
+	if !p.AllowNetwork {
+		cmd.SysProcAttr = isolatedAttr()
+	}
+	return nil
+}
+
+func child(encoded string) int {
+	var p Profile
+	if err := json.Unmarshal([]byte(encoded), &p); err != nil || len(os.Args) < 3 {
+		return fail("invalid sandbox helper invocation")
+	}
+	runtime.LockOSThread()
+	if err := restrict(p.WritePaths); err != nil {
+		return fail(err.Error())
+	}
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envKey+"=") {
+			env = append(env, kv)
+		}
+	}
+	err := syscall.Exec(os.Args[1], os.Args[2:], env)
+	return fail("exec: " + err.Error())
+}
+
+func fail(msg string) int {
+	b, _ := json.Marshal(map[string]string{"code": "ERR_SANDBOX_UNAVAILABLE", "message": msg})
+	fmt.Fprintln(os.Stderr, string(b))
+	return 126
+}
+
+// restrict confines the calling thread so that only writePaths (and
+// alwaysWritable) can be modified. Reads and execution stay unrestricted.
+func restrict(writePaths []string) error {
+	abi := landlockABI()
+	if abi < 1 {
+		return fmt.Errorf("landlock is not supported by this kernel")
+	}
+	handled := uint64(accessWriteFile | accessRemoveDir | accessRemoveFile | accessMakeChar | accessMakeDir |
+		accessMakeReg | accessMakeSock | accessMakeFifo | accessMakeBlock | accessMakeSym)
+	if abi >= 2 {
+		handled |= accessRefer
+	}
+	if abi >= 3 {
+		handled |= accessTruncate
+	}
+	fileAccess := handled & (accessWriteFile | accessTruncate)
+
+	rfd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %s", errno.Error())
+	}
+	defer syscall.Close(int(rfd))
+
+	for _, p := range append(append([]string{}, alwaysWritable...), writePaths...) {
+		fd, err := syscall.Open(p, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			if err == syscall.ENOENT {
+				continue
+			}
+			return fmt.Errorf("open %s: %s", p, err.Error())
+		}
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			syscall.Close(fd)
+			return fmt.Errorf("stat %s: %s", p, err.Error())
+		}
+		attr := pathBeneathAttr{AllowedAccess: handled, ParentFd: int32(fd)}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			attr.AllowedAccess = fileAccess
+		}
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, rfd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+		syscall.Close(fd)
+		if errno != 0 {
+			return fmt.Errorf("landlock_add_rule %s: %s", p, errno.Error())
+		}
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("prctl(no_new_privs): %s", errno.Error())
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, rfd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %s", errno.Error())
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Available reports why sandboxing cannot be used on this platform.
+func Available() error {
+	return fmt.Errorf("%w: requires linux", ErrUnavailable)
+}
+
+// Wrap always fails outside linux; tools that ask for a sandbox never run unconfined.
+func Wrap(cmd *exec.Cmd, p Profile) error {
+	return Available()
+}
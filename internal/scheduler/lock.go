@@ -0,0 +1,80 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Locker serializes runs per workspace path: in process with a channel per
+// path and, when Dir is set, across bridge instances with an advisory file
+// lock under Dir. The zero value locks in process only.
+type Locker struct {
+	Dir string
+
+	mu    sync.Mutex
+	paths map[string]chan struct{}
+}
+
+const lockPollInterval = 25 * time.Millisecond
+
+func (l *Locker) pathSem(path string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.paths == nil {
+		l.paths = map[string]chan struct{}{}
+	}
+	sem, ok := l.paths[path]
+	if !ok {
+		sem = make(chan struct{}, 1)
+		l.paths[path] = sem
+	}
+	return sem
+}
+
+// Lock takes the exclusive lock for path, waiting at most timeout (0 means
+// until ctx is done). It returns the unlock func and how long it waited.
+func (l *Locker) Lock(ctx context.Context, path string, timeout time.Duration) (func(), time.Duration, error) {
+	start := time.Now()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	sem := l.pathSem(path)
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, time.Since(start), lockErr(ctx)
+	}
+	unlockFile := func() {}
+	if l.Dir != "" {
+		sum := sha256.Sum256([]byte(path))
+		f, err := lockFile(ctx, filepath.Join(l.Dir, hex.EncodeToString(sum[:16])+".lock"))
+		if err != nil {
+			<-sem
+			if ctx.Err() != nil {
+				err = lockErr(ctx)
+			}
+			return nil, time.Since(start), err
+		}
+		unlockFile = f
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unlockFile()
+			<-sem
+		})
+	}, time.Since(start), nil
+}
+
+func lockErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrBusy
+	}
+	return ctx.Err()
+}
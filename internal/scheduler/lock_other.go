@@ -0,0 +1,10 @@
+//go:build !unix
+
+package scheduler
+
+import "context"
+
+// lockFile is a no-op without flock; runs are still serialized in process.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,143 @@
+// Package scheduler bounds how many tool runs execute at once, globally and
+// per tool, queueing the excess for a limited time.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBusy means the run could not get a slot: the queue was full or the
+// queue wait timed out.
+var ErrBusy = errors.New("bridge is at capacity")
+
+// Scheduler hands out run slots. A nil *Scheduler imposes no limits.
+type Scheduler struct {
+	global   chan struct{}
+	maxQueue int
+	wait     time.Duration
+
+	mu     sync.Mutex
+	queued int
+	tools  map[string]chan struct{}
+}
+
+// New returns a scheduler allowing maxConcurrent runs at once (0 means no
+// global limit), with at most maxQueue runs waiting up to queueTimeout each.
+func New(maxConcurrent, maxQueue int, queueTimeout time.Duration) *Scheduler {
+	s := &Scheduler{maxQueue: maxQueue, wait: queueTimeout, tools: map[string]chan struct{}{}}
+	if maxConcurrent > 0 {
+		s.global = make(chan struct{}, maxConcurrent)
+	}
+	return s
+}
+
+// RetryAfter is the delay suggested to callers rejected with ErrBusy.
+func (s *Scheduler) RetryAfter() time.Duration {
+	if s == nil || s.wait < time.Second {
+		return time.Second
+	}
+	return s.wait
+}
+
+func (s *Scheduler) toolSem(tool string, limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sem, ok := s.tools[tool]
+	if !ok || cap(sem) != limit {
+		sem = make(chan struct{}, limit)
+		s.tools[tool] = sem
+	}
+	return sem
+}
+
+// Acquire takes a slot for one run of tool, whose own limit is toolLimit
+// (0 means unlimited). It returns the release func and how long it queued.
+func (s *Scheduler) Acquire(ctx context.Context, tool string, toolLimit int) (func(), time.Duration, error) {
+	if s == nil {
+		return func() {}, 0, nil
+	}
+	toolSem := s.toolSem(tool, toolLimit)
+	if tryTake(toolSem) {
+		if tryTake(s.global) {
+			return s.releaser(toolSem), 0, nil
+		}
+		give(toolSem)
+	}
+
+	s.mu.Lock()
+	if s.queued >= s.maxQueue {
+		s.mu.Unlock()
+		return nil, 0, ErrBusy
+	}
+	s.queued++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.queued--
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if s.wait > 0 {
+		t := time.NewTimer(s.wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	if err := take(ctx, toolSem, timeout); err != nil {
+		return nil, time.Since(start), err
+	}
+	if err := take(ctx, s.global, timeout); err != nil {
+		give(toolSem)
+		return nil, time.Since(start), err
+	}
+	return s.releaser(toolSem), time.Since(start), nil
+}
+
+func (s *Scheduler) releaser(toolSem chan struct{}) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			give(s.global)
+			give(toolSem)
+		})
+	}
+}
+
+func tryTake(sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func take(ctx context.Context, sem chan struct{}, timeout <-chan time.Time) error {
+	if sem == nil {
+		return nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func give(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNilSchedulerIsUnlimited(t *testing.T) {
+	var s *Scheduler
+	release, waited, err := s.Acquire(context.Background(), "t", 1)
+	if err != nil || waited != 0 {
+		t.Fatalf("unexpected: %v %v", waited, err)
+	}
+	release()
+}
+
+func TestQueueFullIsBusy(t *testing.T) {
+	s := New(1, 0, time.Second)
+	release, _, err := s.Acquire(context.Background(), "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, _, err := s.Acquire(context.Background(), "b", 0); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy, got %v", err)
+	}
+}
+
+func TestQueueWaitTimesOut(t *testing.T) {
+	s := New(0, 4, 50*time.Millisecond)
+	release, _, err := s.Acquire(context.Background(), "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	_, waited, err := s.Acquire(context.Background(), "a", 1)
+	if !errors.Is(err, ErrBusy) || waited < 50*time.Millisecond {
+		t.Fatalf("expected ErrBusy after queueing, got %v after %v", err, waited)
+	}
+	if r2, _, err := s.Acquire(context.Background(), "b", 1); err != nil {
+		t.Fatalf("other tools must not be limited by a's max_concurrency: %v", err)
+	} else {
+		r2()
+	}
+}
+
+func TestQueuedRunGetsReleasedSlot(t *testing.T) {
+	s := New(1, 4, time.Second)
+	release, _, err := s.Acquire(context.Background(), "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		release()
+	}()
+	r2, waited, err := s.Acquire(context.Background(), "a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2()
+	if waited < 20*time.Millisecond {
+		t.Fatalf("expected queue wait to be reported, got %v", waited)
+	}
+}
+
+func TestLockerSerializesPath(t *testing.T) {
+	l := &Locker{Dir: t.TempDir()}
+	unlock, _, err := l.Lock(context.Background(), "/work/a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.Lock(context.Background(), "/work/a", 50*time.Millisecond); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy while locked, got %v", err)
+	}
+	if u2, _, err := l.Lock(context.Background(), "/work/b", 50*time.Millisecond); err != nil {
+		t.Fatalf("other paths must not be blocked: %v", err)
+	} else {
+		u2()
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		unlock()
+	}()
+	u3, waited, err := l.Lock(context.Background(), "/work/a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u3()
+	if waited < 20*time.Millisecond {
+		t.Fatalf("expected lock wait to be reported, got %v", waited)
+	}
+}
+
+func TestLockerFileLockAcrossInstances(t *testing.T) {
+	dir := t.TempDir()
+	a, b := &Locker{Dir: dir}, &Locker{Dir: dir}
+	unlock, _, err := a.Lock(context.Background(), "/work/a", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if _, _, err := b.Lock(context.Background(), "/work/a", 80*time.Millisecond); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected second instance to be blocked by the file lock, got %v", err)
+	}
+}
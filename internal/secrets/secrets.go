@@ -0,0 +1,124 @@
+// Package secrets resolves tool secrets from the external JCN env directory
+// (see SECRETS_POLICY.md). Values are only ever handed to a tool process.
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"musketeer-bridge/internal/registry"
+)
+
+// Resolve looks up every ref under dir. A ref's source is either a dotenv
+// file or a directory holding one file per secret; the key defaults to the
+// ref name. Any missing secret fails the whole resolution.
+func Resolve(dir string, refs []registry.SecretRef) (map[string]string, error) {
+	out := map[string]string{}
+	for _, ref := range refs {
+		v, err := lookup(dir, ref)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %s", ref.Name, err.Error())
+		}
+		out[ref.Name] = v
+	}
+	return out, nil
+}
+
+func lookup(dir string, ref registry.SecretRef) (string, error) {
+	if ref.Name == "" || ref.Source == "" {
+		return "", fmt.Errorf("name and source are required")
+	}
+	if dir == "" {
+		return "", fmt.Errorf("secrets_dir is not configured")
+	}
+	if !filepath.IsLocal(ref.Source) {
+		return "", fmt.Errorf("source %q must be relative to secrets_dir", ref.Source)
+	}
+	key := ref.Key
+	if key == "" {
+		key = ref.Name
+	}
+	p := filepath.Join(dir, ref.Source)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", fmt.Errorf("source %q not found", ref.Source)
+	}
+	if fi.IsDir() {
+		if !filepath.IsLocal(key) {
+			return "", fmt.Errorf("key %q is not a valid file name", key)
+		}
+		b, err := os.ReadFile(filepath.Join(p, key))
+		if err != nil {
+			return "", fmt.Errorf("key %q not found in %q", key, ref.Source)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("source %q is not readable", ref.Source)
+	}
+	if v, ok := ParseDotenv(b)[key]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("key %q not found in %q", key, ref.Source)
+}
+
+// ParseDotenv reads KEY=VALUE lines, ignoring blank lines and # comments.
+// An optional "export " prefix and matching surrounding quotes are stripped.
+func ParseDotenv(b []byte) map[string]string {
+	out := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// Scrub replaces every occurrence of a secret value in s.
+func Scrub(s string, values map[string]string) string {
+	for _, v := range values {
+		if v != "" {
+			s = strings.ReplaceAll(s, v, "[redacted]")
+		}
+	}
+	return s
+}
+
+// ScrubJSON applies Scrub to every string (and object key) in a decoded JSON value.
+func ScrubJSON(v any, values map[string]string) any {
+	switch vv := v.(type) {
+	case string:
+		return Scrub(vv, values)
+	case map[string]any:
+		out := make(map[string]any, len(vv))
+		for k, x := range vv {
+			out[Scrub(k, values)] = ScrubJSON(x, values)
+		}
+		return out
+	case []any:
+		out := make([]any, len(vv))
+		for i, x := range vv {
+			out[i] = ScrubJSON(x, values)
+		}
+		return out
+	default:
+		return v
+	}
+}
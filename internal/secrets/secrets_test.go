@@ -0,0 +1,48 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"musketeer-bridge/internal/registry"
+)
+
+func TestParseDotenv(t *testing.T) {
+	got := ParseDotenv([]byte("# comment\n\nexport A=1\nB = \"two words\"\nC='x=y'\nbad line\n"))
+	if got["A"] != "1" || got["B"] != "two words" || got["C"] != "x=y" || len(got) != 3 {
+		t.Fatalf("unexpected dotenv parse: %v", got)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "musketeer-bridge.env"), []byte("API_TOKEN=abc123\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "files", "db_password"), []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Resolve(dir, []registry.SecretRef{
+		{Name: "API_TOKEN", Source: "musketeer-bridge.env"},
+		{Name: "DB_PASSWORD", Source: "files", Key: "db_password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["API_TOKEN"] != "abc123" || got["DB_PASSWORD"] != "hunter2" {
+		t.Fatalf("unexpected secrets: %v", got)
+	}
+	for _, ref := range []registry.SecretRef{
+		{Name: "MISSING", Source: "musketeer-bridge.env"},
+		{Name: "API_TOKEN", Source: "nope.env"},
+		{Name: "API_TOKEN", Source: "../musketeer-bridge.env"},
+	} {
+		if _, err := Resolve(dir, []registry.SecretRef{ref}); err == nil {
+			t.Fatalf("expected error for %+v", ref)
+		}
+	}
+}
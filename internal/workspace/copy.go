@@ -0,0 +1,176 @@
+// Package workspace prepares scratch copies of a project for dry runs and
+// renders what a run changed in them as a unified patch.
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"musketeer-bridge/internal/artifacts"
+)
+
+// Copy recreates the tree at src under dst, preserving permissions. File
+// contents are reflinked where the filesystem supports it and copied
+// otherwise; hard links are never used, since a tool writing a file in place
+// would then modify the original. Symlinks must not lead a tool back into
+// src or elsewhere, so a link to something inside src is recreated pointing
+// at its copy, a link to a regular file outside src is replaced by a copy of
+// that file, and a dangling link is left out. Any other link leaving src is
+// an error. dst is skipped if it lies within src. Copy fails once more than
+// lim.MaxFiles files or lim.MaxTotalBytes bytes would be copied; zero means
+// no limit.
+func Copy(src, dst string, lim artifacts.TreeLimits) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	realDst, err := resolveDst(dst)
+	if err != nil {
+		return err
+	}
+	files, size := 0, int64(0)
+	count := func(n int64) error {
+		files, size = files+1, size+n
+		if lim.MaxFiles > 0 && files > lim.MaxFiles {
+			return fmt.Errorf("%s has more than %d files", src, lim.MaxFiles)
+		}
+		if lim.MaxTotalBytes > 0 && size > lim.MaxTotalBytes {
+			return fmt.Errorf("%s is larger than %d bytes", src, lim.MaxTotalBytes)
+		}
+		return nil
+	}
+	// Directories stay 0700 until everything is copied, so a read-only
+	// directory does not stop a non-root daemon from filling it.
+	type dirMode struct {
+		path string
+		mode fs.FileMode
+	}
+	var dirs []dirMode
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && p == realDst {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			dirs = append(dirs, dirMode{target, info.Mode().Perm()})
+			return os.MkdirAll(target, 0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			return copyLink(src, dst, p, target, count)
+		case d.Type().IsRegular():
+			if err := count(info.Size()); err != nil {
+				return err
+			}
+			return copyFile(p, target, info.Mode().Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes a tree made by Copy, first making its directories writable
+// so that read-only ones copied from the original can be emptied.
+func Remove(dir string) error {
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(p, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+// resolveDst resolves the symlinks in dst, which need not exist yet.
+func resolveDst(dst string) (string, error) {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return "", err
+	}
+	if r, err := filepath.EvalSymlinks(dst); err == nil {
+		return r, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(dst))
+	if err != nil {
+		return dst, nil
+	}
+	return filepath.Join(dir, filepath.Base(dst)), nil
+}
+
+// copyLink recreates the symlink p (beneath the resolved src) at target.
+// count is charged for the link, or for the file copied in its place.
+func copyLink(src, dst, p, target string, count func(int64) error) error {
+	resolved, err := filepath.EvalSymlinks(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(src, resolved); err == nil && filepath.IsLocal(rel) {
+		if err := count(0); err != nil {
+			return err
+		}
+		link, err := filepath.Rel(filepath.Dir(target), filepath.Join(dst, rel))
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("symlink %s leads outside the workspace", p)
+	}
+	if err := count(info.Size()); err != nil {
+		return err
+	}
+	return copyFile(resolved, target, info.Mode().Perm())
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if !reflink(in, out) {
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Chmod(perm); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
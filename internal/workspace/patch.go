@@ -0,0 +1,244 @@
+package workspace
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"musketeer-bridge/internal/artifacts"
+)
+
+// contextLines is the number of unchanged lines around each hunk.
+const contextLines = 3
+
+// Patch renders changes between the trees at oldRoot and newRoot as a
+// unified diff with a/ and b/ prefixes. Binary files, files larger than
+// maxBytes and changes too large to diff are listed but not diffed.
+func Patch(oldRoot, newRoot string, changes []artifacts.Artifact, maxBytes int64) string {
+	var b strings.Builder
+	for _, c := range changes {
+		var oldText, newText []byte
+		oldName, newName := "a/"+c.Path, "b/"+c.Path
+		var err error
+		if c.Change != "created" {
+			if oldText, err = readSmall(filepath.Join(oldRoot, filepath.FromSlash(c.Path)), maxBytes); err != nil {
+				fmt.Fprintf(&b, "Files %s and %s differ\n", oldName, newName)
+				continue
+			}
+		} else {
+			oldName = "/dev/null"
+		}
+		if c.Change != "deleted" {
+			if newText, err = readSmall(filepath.Join(newRoot, filepath.FromSlash(c.Path)), maxBytes); err != nil {
+				fmt.Fprintf(&b, "Files %s and %s differ\n", oldName, newName)
+				continue
+			}
+		} else {
+			newName = "/dev/null"
+		}
+		if isBinary(oldText) || isBinary(newText) {
+			fmt.Fprintf(&b, "Binary files %s and %s differ\n", oldName, newName)
+			continue
+		}
+		edits, ok := diffLines(splitLines(oldText), splitLines(newText))
+		if !ok {
+			fmt.Fprintf(&b, "Files %s and %s differ\n", oldName, newName)
+			continue
+		}
+		hunks := unified(edits)
+		if hunks == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "--- %s\n+++ %s\n%s", oldName, newName, hunks)
+	}
+	return b.String()
+}
+
+func readSmall(path string, maxBytes int64) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > maxBytes {
+		return nil, fmt.Errorf("%s is too large to diff", path)
+	}
+	return os.ReadFile(path)
+}
+
+func isBinary(b []byte) bool {
+	return bytes.IndexByte(b, 0) >= 0 || !utf8.Valid(b)
+}
+
+// splitLines splits text into lines that keep their trailing newline, so a
+// missing final newline shows up as a difference.
+func splitLines(b []byte) []string {
+	var lines []string
+	s := string(b)
+	for s != "" {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// edit is one line of a diff: ' ' kept, '-' removed or '+' added.
+type edit struct {
+	kind byte
+	text string
+}
+
+// Myers' algorithm keeps O(D²) state for D edits and takes O((N+M)·D) time,
+// so files whose differing middle exceeds maxDiffLines lines, or whose edit
+// script exceeds maxDiffEdits, are not diffed.
+const (
+	maxDiffLines = 20000
+	maxDiffEdits = 1000
+)
+
+// diffLines computes a shortest edit script from a to b (Myers' algorithm),
+// after stripping the common prefix and suffix. It reports false when the
+// difference is too large to diff.
+func diffLines(a, b []string) ([]edit, bool) {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	mid, ok := myers(a[pre:len(a)-suf], b[pre:len(b)-suf])
+	if !ok {
+		return nil, false
+	}
+	out := make([]edit, 0, pre+len(mid)+suf)
+	for _, l := range a[:pre] {
+		out = append(out, edit{' ', l})
+	}
+	out = append(out, mid...)
+	for _, l := range a[len(a)-suf:] {
+		out = append(out, edit{' ', l})
+	}
+	return out, true
+}
+
+func myers(a, b []string) ([]edit, bool) {
+	n, m := len(a), len(b)
+	total := n + m
+	if total > maxDiffLines {
+		return nil, false
+	}
+	off := total + 1
+	v := make([]int, 2*total+3)
+	var trace [][]int
+	for d := 0; d <= min(total, maxDiffEdits); d++ {
+		snap := make([]int, 2*d+3)
+		copy(snap, v[off-d-1:off+d+2])
+		trace = append(trace, snap)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func backtrack(a, b []string, trace [][]int) []edit {
+	var rev []edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			rev = append(rev, edit{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if d > 0 {
+			if x == prevX {
+				rev = append(rev, edit{'+', b[y-1]})
+			} else {
+				rev = append(rev, edit{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	out := make([]edit, len(rev))
+	for i, e := range rev {
+		out[len(rev)-1-i] = e
+	}
+	return out
+}
+
+// unified formats an edit script as unified diff hunks.
+func unified(edits []edit) string {
+	oldNo := make([]int, len(edits)+1)
+	newNo := make([]int, len(edits)+1)
+	var changed []int
+	for i, e := range edits {
+		oldNo[i+1], newNo[i+1] = oldNo[i], newNo[i]
+		if e.kind != '+' {
+			oldNo[i+1]++
+		}
+		if e.kind != '-' {
+			newNo[i+1]++
+		}
+		if e.kind != ' ' {
+			changed = append(changed, i)
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(changed); {
+		start := max(changed[i]-contextLines, 0)
+		end := changed[i] + 1
+		for i++; i < len(changed) && changed[i] <= end+2*contextLines; i++ {
+			end = changed[i] + 1
+		}
+		end = min(end+contextLines, len(edits))
+		oldStart, oldCount := oldNo[start], oldNo[end]-oldNo[start]
+		newStart, newCount := newNo[start], newNo[end]-newNo[start]
+		if oldCount > 0 {
+			oldStart++
+		}
+		if newCount > 0 {
+			newStart++
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, e := range edits[start:end] {
+			b.WriteByte(e.kind)
+			b.WriteString(e.text)
+			if !strings.HasSuffix(e.text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package workspace
+
+import "os"
+
+func reflink(src, dst *os.File) bool {
+	return false
+}
@@ -0,0 +1,191 @@
+package workspace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"musketeer-bridge/internal/artifacts"
+)
+
+func TestCopyAndPatch(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("one\ntwo\nthree\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/a.txt", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "copy")
+	if err := Copy(src, dst, artifacts.TreeLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	lim := artifacts.TreeLimits{MaxFileBytes: 1 << 20}
+	before, _ := artifacts.SnapshotTree(src, lim)
+	after, _ := artifacts.SnapshotTree(dst, lim)
+	if got := artifacts.Changes(before, after); len(got) != 0 {
+		t.Fatalf("expected an identical copy, got changes %+v", got)
+	}
+	if l, err := os.Readlink(filepath.Join(dst, "link")); err != nil || l != "sub/a.txt" {
+		t.Fatalf("expected symlink to be preserved, got %q, %v", l, err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "sub", "a.txt"), []byte("one\n2\nthree\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "new.txt"), []byte("fresh"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	after, _ = artifacts.SnapshotTree(dst, lim)
+	changes := artifacts.Changes(before, after)
+	want := "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,1 @@\n+fresh\n\\ No newline at end of file\n" +
+		"--- a/sub/a.txt\n+++ b/sub/a.txt\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n"
+	if got := Patch(src, dst, changes, 1<<20); got != want {
+		t.Fatalf("unexpected patch:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCopyConfinesSymlinks(t *testing.T) {
+	src, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "in.txt"), []byte("in"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "out.txt"), []byte("out"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"abs":      filepath.Join(src, "in.txt"),
+		"external": filepath.Join(outside, "out.txt"),
+		"dangling": filepath.Join(outside, "missing"),
+	} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := filepath.Join(t.TempDir(), "copy")
+	if err := Copy(src, dst, artifacts.TreeLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := os.Readlink(filepath.Join(dst, "abs")); err != nil || l != "in.txt" {
+		t.Fatalf("expected the absolute link to point at the copy, got %q, %v", l, err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dst, "external")); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("expected the external link to be dereferenced, got %v, %v", fi, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "dangling")); !os.IsNotExist(err) {
+		t.Fatalf("expected the dangling link to be left out, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "external"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "abs"), []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{filepath.Join(outside, "out.txt"), filepath.Join(src, "in.txt")} {
+		if b, _ := os.ReadFile(f); string(b) == "changed" {
+			t.Fatalf("writing through the copy changed %s", f)
+		}
+	}
+
+	if err := os.Symlink(outside, filepath.Join(src, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Copy(src, filepath.Join(t.TempDir(), "copy"), artifacts.TreeLimits{}); err == nil {
+		t.Fatal("expected a directory link leaving the tree to be rejected")
+	}
+}
+
+func TestCopySkipsDestinationAndLimits(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte("0123456789"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, lim := range []artifacts.TreeLimits{{MaxFiles: 2}, {MaxTotalBytes: 25}} {
+		if err := Copy(src, filepath.Join(t.TempDir(), "copy"), lim); err == nil {
+			t.Fatalf("expected %+v to stop the copy", lim)
+		}
+	}
+	if err := Copy(src, filepath.Join(t.TempDir(), "copy"), artifacts.TreeLimits{MaxFiles: 3, MaxTotalBytes: 30}); err != nil {
+		t.Fatalf("expected a tree within the limits to be copied, got %v", err)
+	}
+	dst := filepath.Join(src, "scratch", "run-1")
+	if err := Copy(src, dst, artifacts.TreeLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "scratch", "run-1")); !os.IsNotExist(err) {
+		t.Fatalf("expected the copy not to contain itself, got %v", err)
+	}
+}
+
+func TestCopyReadOnlyDirs(t *testing.T) {
+	src := t.TempDir()
+	ro := filepath.Join(src, "ro")
+	if err := os.MkdirAll(filepath.Join(ro, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(ro, "sub", "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{filepath.Join(ro, "sub"), ro} {
+		if err := os.Chmod(d, 0o555); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { _ = os.Chmod(ro, 0o755); _ = os.Chmod(filepath.Join(ro, "sub"), 0o755) })
+	dst := filepath.Join(t.TempDir(), "copy")
+	if err := Copy(src, dst, artifacts.TreeLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{filepath.Join(dst, "ro"), filepath.Join(dst, "ro", "sub")} {
+		if fi, err := os.Stat(d); err != nil || fi.Mode().Perm() != 0o555 {
+			t.Fatalf("expected %s to keep mode 0555, got %v, %v", d, fi, err)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dst, "ro", "sub", "a.txt")); err != nil || string(b) != "a" {
+		t.Fatalf("expected the file in the read-only dir to be copied, got %q, %v", b, err)
+	}
+	if err := Remove(dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("expected the copy to be removed, got %v", err)
+	}
+}
+
+func TestPatchLargeChanges(t *testing.T) {
+	lines := func(n int, f string) string {
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, f, i)
+		}
+		return b.String()
+	}
+	a, b := t.TempDir(), t.TempDir()
+	files := map[string][2]string{
+		"rewrite.txt": {lines(3000, "old %d\n"), lines(3000, "new %d\n")},
+		"onefix.txt":  {lines(50000, "line %d\n"), strings.Replace(lines(50000, "line %d\n"), "line 25000\n", "fixed\n", 1)},
+	}
+	var changes []artifacts.Artifact
+	for name, texts := range files {
+		if err := os.WriteFile(filepath.Join(a, name), []byte(texts[0]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(b, name), []byte(texts[1]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, artifacts.Artifact{File: artifacts.File{Path: name}, Change: "modified"})
+	}
+	p := Patch(a, b, changes, 8<<20)
+	if !strings.Contains(p, "Files a/rewrite.txt and b/rewrite.txt differ\n") {
+		t.Fatalf("expected the full rewrite to be listed without content, got %.200q", p)
+	}
+	if !strings.Contains(p, "@@ -24998,7 +24998,7 @@\n line 24997\n line 24998\n line 24999\n-line 25000\n+fixed\n") {
+		t.Fatalf("expected a small hunk for the one-line change, got %.500q", p)
+	}
+}